@@ -0,0 +1,369 @@
+// redisqueue 队列运维工具
+//
+//	redisqueue [全局参数] <命令> [参数]
+//
+// 全局参数也可以用环境变量设置：REDISQUEUE_ADDR、REDISQUEUE_PASSWORD、REDISQUEUE_DB
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"hallversion/common/qqredis"
+	"hallversion/common/redisqueue"
+)
+
+const usage = `用法: redisqueue [全局参数] <命令> [参数]
+
+命令:
+  stats [前缀]                        列出队列以及待处理、延迟、处理中、死信数量
+  peek <队列>                         按出列顺序查看待处理的消息
+  enqueue --json <消息> <队列>        入列一条消息，消息为json对象
+  requeue-dead <队列>                 把死信放回原队列，默认全部
+  purge <队列>                        清空待处理和延迟中的消息并释放唯一锁
+  move <源队列> <目标队列>            移动待处理的消息
+  tail <队列>                         持续输出新入列的消息，轮询待处理列表，
+                                      两次轮询之间就被消费掉的消息不会输出
+
+全局参数:
+`
+
+type runFunc func(a *redisqueue.Admin, q *redisqueue.RedisQueue, args []string) error
+
+type command struct {
+	flags *flag.FlagSet
+	run   runFunc
+}
+
+func main() {
+	global := flag.NewFlagSet("redisqueue", flag.ExitOnError)
+	addr := global.String("addr", env("REDISQUEUE_ADDR", "127.0.0.1:6379"), "redis地址")
+	password := global.String("password", env("REDISQUEUE_PASSWORD", ""), "redis密码")
+	db := global.Int("db", envInt("REDISQUEUE_DB", 0), "redis db")
+	levels := global.Int("priority-levels", 0, "优先级数量，需要和生产者、消费者一致")
+	deadSuffix := global.String("dead-suffix", redisqueue.DefaultDeadLetterSuffix, "死信队列后缀")
+	global.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		global.PrintDefaults()
+	}
+	global.Parse(os.Args[1:])
+
+	if global.NArg() == 0 {
+		global.Usage()
+		os.Exit(2)
+	}
+
+	commands := newCommands()
+	name := global.Arg(0)
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "未知命令: %s\n\n", name)
+		global.Usage()
+		os.Exit(2)
+	}
+	args := parseArgs(cmd.flags, global.Args()[1:])
+
+	rc := qqredis.NewRedisCache(*addr, *password, time.Hour, *db)
+	q := redisqueue.NewRedisQueue(rc, "",
+		redisqueue.WithPriorityLevels(*levels),
+		redisqueue.WithDeadLetterSuffix(*deadSuffix))
+
+	if err := cmd.run(redisqueue.NewAdmin(q), q, args); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		os.Exit(1)
+	}
+}
+
+func newCommands() map[string]*command {
+	commands := make(map[string]*command)
+	add := func(name string, run func(fs *flag.FlagSet) runFunc) {
+		fs := flag.NewFlagSet(name, flag.ExitOnError)
+		commands[name] = &command{flags: fs, run: run(fs)}
+	}
+
+	add("stats", func(fs *flag.FlagSet) runFunc {
+		return func(a *redisqueue.Admin, q *redisqueue.RedisQueue, args []string) error {
+			prefix := ""
+			if len(args) > 0 {
+				prefix = args[0]
+			}
+			stats, err := a.QueueStats(prefix)
+			if err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "QUEUE\tREADY\tDELAYED\tPROCESSING\tDEAD\tCONSUMERS")
+			for _, st := range stats {
+				fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\n", st.Name, st.Ready, st.Delayed, st.Processing, st.Dead, st.Consumers)
+			}
+			return w.Flush()
+		}
+	})
+
+	add("peek", func(fs *flag.FlagSet) runFunc {
+		offset := fs.Int("offset", 0, "跳过的消息数量")
+		count := fs.Int("count", 10, "最多输出的消息数量")
+		guid := fs.String("uuid", "", "按uuid查找消息，包括延迟中、处理中的消息和死信")
+		return func(a *redisqueue.Admin, q *redisqueue.RedisQueue, args []string) error {
+			queuename, err := arg(args, 0, "队列")
+			if err != nil {
+				return err
+			}
+			if *guid != "" {
+				fm, err := a.Find(queuename, *guid)
+				if err != nil {
+					return err
+				}
+				return printJSON(fm)
+			}
+			qms, err := a.Peek(queuename, *offset, *count)
+			if err != nil {
+				return err
+			}
+			for _, qm := range qms {
+				if err := printJSON(qm); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	})
+
+	add("enqueue", func(fs *flag.FlagSet) runFunc {
+		body := fs.String("json", "", "消息体，json对象")
+		weight := fs.Int("weight", 1, "消息权重")
+		retry := fs.Int("retry", 3, "重试次数")
+		delay := fs.Duration("delay", 0, "延迟投递的时间")
+		unique := fs.String("unique", "", "唯一键，同一唯一键的消息在--unique-ttl内只会入列一次")
+		uniqueTTL := fs.Duration("unique-ttl", 0, "唯一键的有效期，0为一直持有到消息处理完或者进入死信队列")
+		return func(a *redisqueue.Admin, q *redisqueue.RedisQueue, args []string) error {
+			queuename, err := arg(args, 0, "队列")
+			if err != nil {
+				return err
+			}
+			var msg map[string]interface{}
+			if err := json.Unmarshal([]byte(*body), &msg); err != nil {
+				return fmt.Errorf("--json: %v", err)
+			}
+
+			var opts []redisqueue.MsgOption
+			if *unique != "" {
+				opts = append(opts, redisqueue.WithUniqueKey(*unique, *uniqueTTL))
+			}
+			qm, err := redisqueue.NewQueueMsg(msg, *weight, *retry, opts...)
+			if err != nil {
+				return err
+			}
+			if *delay > 0 {
+				err = q.EnQueueIn(qm, queuename, *delay)
+			} else {
+				err = q.EnQueue(qm, queuename)
+			}
+			if err != nil {
+				return err
+			}
+			fmt.Println(qm.UUID)
+			return nil
+		}
+	})
+
+	add("requeue-dead", func(fs *flag.FlagSet) runFunc {
+		guid := fs.String("uuid", "", "只放回一条死信")
+		retry := fs.Int("retry", 3, "重新设置的重试次数")
+		return func(a *redisqueue.Admin, q *redisqueue.RedisQueue, args []string) error {
+			queuename, err := arg(args, 0, "队列")
+			if err != nil {
+				return err
+			}
+			if *guid != "" {
+				if err := q.RequeueDead(queuename, *guid, *retry); err != nil {
+					return err
+				}
+				fmt.Println(1)
+				return nil
+			}
+			n, err := q.RequeueAllDead(queuename, *retry)
+			fmt.Println(n)
+			return err
+		}
+	})
+
+	add("purge", func(fs *flag.FlagSet) runFunc {
+		dead := fs.Bool("dead", false, "同时清空死信")
+		return func(a *redisqueue.Admin, q *redisqueue.RedisQueue, args []string) error {
+			queuename, err := arg(args, 0, "队列")
+			if err != nil {
+				return err
+			}
+			n, err := a.Purge(queuename)
+			if err != nil {
+				return err
+			}
+			if *dead {
+				if err := q.PurgeDead(queuename); err != nil {
+					return err
+				}
+			}
+			fmt.Println(n)
+			return nil
+		}
+	})
+
+	add("move", func(fs *flag.FlagSet) runFunc {
+		count := fs.Int("count", 0, "移动的数量，0为全部")
+		guid := fs.String("uuid", "", "只移动一条消息")
+		return func(a *redisqueue.Admin, q *redisqueue.RedisQueue, args []string) error {
+			from, err := arg(args, 0, "源队列")
+			if err != nil {
+				return err
+			}
+			to, err := arg(args, 1, "目标队列")
+			if err != nil {
+				return err
+			}
+			if *guid != "" {
+				if err := a.MoveMsg(from, to, *guid); err != nil {
+					return err
+				}
+				fmt.Println(1)
+				return nil
+			}
+			n, err := a.Move(from, to, *count)
+			fmt.Println(n)
+			return err
+		}
+	})
+
+	add("tail", func(fs *flag.FlagSet) runFunc {
+		interval := fs.Duration("interval", time.Second, "轮询间隔")
+		count := fs.Int("count", 100, "每次检查的最新消息数量")
+		dead := fs.Bool("dead", false, "输出新的死信")
+		return func(a *redisqueue.Admin, q *redisqueue.RedisQueue, args []string) error {
+			queuename, err := arg(args, 0, "队列")
+			if err != nil {
+				return err
+			}
+			if *dead {
+				return tailDead(q, queuename, *count, *interval)
+			}
+			return tail(a, queuename, *count, *interval)
+		}
+	})
+
+	return commands
+}
+
+//轮询最新的消息，输出没有输出过的
+//只能看到轮询时还在待处理列表里的消息，消费者处理得快时会漏掉，需要完整记录时用消费者中间件
+func tail(a *redisqueue.Admin, queuename string, count int, interval time.Duration) error {
+	seen := make(map[string]bool)
+	for {
+		st, err := a.Stats(queuename)
+		if err != nil {
+			return err
+		}
+		offset := st.Ready - count
+		if offset < 0 {
+			offset = 0
+		}
+		qms, err := a.Peek(queuename, offset, count)
+		if err != nil {
+			return err
+		}
+
+		current := make(map[string]bool, len(qms))
+		for _, qm := range qms {
+			current[qm.UUID] = true
+			if seen[qm.UUID] {
+				continue
+			}
+			if err := printJSON(qm); err != nil {
+				return err
+			}
+		}
+		seen = current
+		time.Sleep(interval)
+	}
+}
+
+func tailDead(q *redisqueue.RedisQueue, queuename string, count int, interval time.Duration) error {
+	seen := make(map[string]bool)
+	for {
+		dms, err := q.DeadMsgs(queuename, 0, count-1)
+		if err != nil {
+			return err
+		}
+
+		current := make(map[string]bool, len(dms))
+		//最新的在最前面，倒序输出
+		for i := len(dms) - 1; i >= 0; i-- {
+			key := string(mustJSON(dms[i]))
+			current[key] = true
+			if seen[key] {
+				continue
+			}
+			fmt.Println(key)
+		}
+		seen = current
+		time.Sleep(interval)
+	}
+}
+
+//解析命令的参数，参数可以写在位置参数后面，例如 peek q --count 5
+//"--"之后的都作为位置参数
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		rest := fs.Args()
+		if len(rest) == 0 {
+			return positional
+		}
+		if n := len(args) - len(rest); n > 0 && args[n-1] == "--" {
+			return append(positional, rest...)
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+func arg(args []string, i int, name string) (string, error) {
+	if len(args) <= i || args[i] == "" {
+		return "", errors.New("缺少参数: " + name)
+	}
+	return args[i], nil
+}
+
+func printJSON(v interface{}) error {
+	bt, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(bt))
+	return nil
+}
+
+func mustJSON(v interface{}) []byte {
+	bt, _ := json.Marshal(v)
+	return bt
+}
+
+func env(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func envInt(key string, def int) int {
+	if v, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"flag"
+	"reflect"
+	"testing"
+)
+
+func TestParseArgs(t *testing.T) {
+	for _, c := range []struct {
+		args  []string
+		count int
+		want  []string
+	}{
+		{[]string{"q"}, 10, []string{"q"}},
+		{[]string{"--count", "5", "q"}, 5, []string{"q"}},
+		{[]string{"q", "--count", "5"}, 5, []string{"q"}},
+		{[]string{"from", "--count", "5", "to"}, 5, []string{"from", "to"}},
+		{[]string{"--", "--count", "q"}, 10, []string{"--count", "q"}},
+		{[]string{"q", "--", "--count"}, 10, []string{"q", "--count"}},
+		{nil, 10, nil},
+	} {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		count := fs.Int("count", 10, "")
+		got := parseArgs(fs, c.args)
+		if !reflect.DeepEqual(got, c.want) || *count != c.count {
+			t.Errorf("parseArgs(%q) = %q, count %d, want %q, count %d", c.args, got, *count, c.want, c.count)
+		}
+	}
+}
@@ -1,9 +1,11 @@
 package qqredis
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/garyburd/redigo/redis"
+	"go.opentelemetry.io/otel/trace"
 	// "github.com/robfig/config"
 	"errors"
 	"time"
@@ -22,6 +24,7 @@ var (
 type RedisCache struct {
 	pool              *redis.Pool
 	defaultExpiration time.Duration
+	tracer            trace.Tracer
 }
 type Getter interface {
 	// Get the content associated with the given key. decoding it into the given
@@ -77,7 +80,7 @@ func NewRedisCache(host string, password string, defaultExpiration time.Duration
 			return nil
 		},
 	}
-	return RedisCache{pool, defaultExpiration}
+	return RedisCache{pool: pool, defaultExpiration: defaultExpiration}
 }
 
 func (c RedisCache) Set(key string, value interface{}, expires time.Duration) error {
@@ -1084,6 +1087,96 @@ func (c RedisCache) BRpop(key string, time int) (string, []byte, error) {
 	return queuename, item, err
 }
 
+//执行命令，ctx有deadline时作为命令的超时时间
+func (c RedisCache) DoContext(ctx context.Context, cmd string, args ...interface{}) (reply interface{}, err error) {
+	span := c.startSpan(ctx, cmd)
+	defer func() { EndSpan(span, err) }()
+
+	timeout, err := ctxTimeout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn := c.pool.Get()
+	defer conn.Close()
+	if timeout > 0 {
+		return redis.DoWithTimeout(conn, timeout, cmd, args...)
+	}
+	return conn.Do(cmd, args...)
+}
+
+//执行lua脚本，ctx有deadline时作为命令的超时时间
+func (c RedisCache) EvalContext(ctx context.Context, script *redis.Script, keysAndArgs ...interface{}) (reply interface{}, err error) {
+	span := c.startSpan(ctx, "EVALSHA")
+	defer func() { EndSpan(span, err) }()
+
+	timeout, err := ctxTimeout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn := c.pool.Get()
+	defer conn.Close()
+	if timeout > 0 {
+		conn = timeoutConn{conn, timeout}
+	}
+	return script.Do(conn, keysAndArgs...)
+}
+
+//ctx剩余的时间，没有deadline时返回0
+func ctxTimeout(ctx context.Context) (time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0, nil
+	}
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		return 0, context.DeadlineExceeded
+	}
+	return timeout, nil
+}
+
+//每个命令都带超时的连接
+type timeoutConn struct {
+	redis.Conn
+	timeout time.Duration
+}
+
+func (c timeoutConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return redis.DoWithTimeout(c.Conn, c.timeout, cmd, args...)
+}
+
+//执行lua脚本
+func (c RedisCache) Eval(script *redis.Script, keysAndArgs ...interface{}) (interface{}, error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+	return script.Do(conn, keysAndArgs...)
+}
+
+//用SCAN遍历匹配的key，不会像KEYS一样阻塞redis
+func (c RedisCache) Scan(match string, count int) ([]string, error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	var keys []string
+	cursor := 0
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", match, "COUNT", count))
+		if err != nil {
+			return nil, err
+		}
+		var page []string
+		if _, err := redis.Scan(values, &cursor, &page); err != nil {
+			return nil, err
+		}
+		keys = append(keys, page...)
+		if cursor == 0 {
+			return keys, nil
+		}
+	}
+}
+
 func (c RedisCache) Zincrbyfloat64(key, member string, inc float64) (float64, error) {
 	conn := c.pool.Get()
 	defer conn.Close()
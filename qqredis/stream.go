@@ -0,0 +1,210 @@
+package qqredis
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var ErrStreamReply = errors.New("rediscache: unexpected stream reply.")
+
+// 流里的一条消息
+type StreamEntry struct {
+	Stream string            //所在的流
+	ID     string            //消息ID
+	Fields map[string]string //字段，消息已经被删除（例如被MAXLEN裁剪）时为nil
+}
+
+// 消费组里已经投递但还没确认的消息
+type PendingEntry struct {
+	ID         string        //消息ID
+	Consumer   string        //持有消息的消费者
+	Idle       time.Duration //距离上次投递的时间
+	Deliveries int64         //投递次数
+}
+
+//添加消息，maxLen大于0时裁剪到maxLen条，approx为true时按"~"近似裁剪（性能更好）
+//fields为字段和值交替，返回消息ID
+func (c RedisCache) Xadd(ctx context.Context, key string, maxLen int64, approx bool, fields ...interface{}) (string, error) {
+	args := []interface{}{key}
+	if maxLen > 0 && approx {
+		args = append(args, "MAXLEN", "~", maxLen)
+	} else if maxLen > 0 {
+		args = append(args, "MAXLEN", maxLen)
+	}
+	args = append(args, "*")
+	args = append(args, fields...)
+	return redis.String(c.DoContext(ctx, "XADD", args...))
+}
+
+//创建消费组，start为开始读取的位置（"0"从头，"$"只读新消息），流不存在时自动创建
+//消费组已经存在时不返回错误
+func (c RedisCache) Xgroupcreate(ctx context.Context, key, group, start string) error {
+	_, err := c.DoContext(ctx, "XGROUP", "CREATE", key, group, start, "MKSTREAM")
+	if err != nil && strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil
+	}
+	return err
+}
+
+//删除消费组里的消费者，返回它还没确认的消息数量（这些消息会一起从消费组删除）
+func (c RedisCache) Xgroupdelconsumer(ctx context.Context, key, group, consumer string) (int, error) {
+	return redis.Int(c.DoContext(ctx, "XGROUP", "DELCONSUMER", key, group, consumer))
+}
+
+//按消费组读取消息，ids为每个流开始读取的位置（">"为未投递过的新消息），block大于0时最多堵塞block
+//没有消息时返回nil
+func (c RedisCache) Xreadgroup(ctx context.Context, group, consumer string, count int, block time.Duration, streams []string, ids []string) ([]StreamEntry, error) {
+	args := []interface{}{"GROUP", group, consumer, "COUNT", count}
+	if block > 0 {
+		//BLOCK 0是一直堵塞，不足1毫秒的按1毫秒
+		ms := int64(block / time.Millisecond)
+		if ms == 0 {
+			ms = 1
+		}
+		args = append(args, "BLOCK", ms)
+	}
+	args = append(args, "STREAMS")
+	for _, s := range streams {
+		args = append(args, s)
+	}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+
+	raw, err := c.DoContext(ctx, "XREADGROUP", args...)
+	if err != nil || raw == nil {
+		return nil, err
+	}
+	replies, err := redis.Values(raw, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []StreamEntry
+	for _, r := range replies {
+		kv, err := redis.Values(r, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(kv) != 2 {
+			return nil, ErrStreamReply
+		}
+		stream, err := redis.String(kv[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		es, err := parseStreamEntries(stream, kv[1])
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, es...)
+	}
+	return entries, nil
+}
+
+//确认消息，返回确认成功的数量
+func (c RedisCache) Xack(ctx context.Context, key, group string, ids ...string) (int, error) {
+	args := []interface{}{key, group}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	return redis.Int(c.DoContext(ctx, "XACK", args...))
+}
+
+//把消费组里空闲超过minIdle的消息转给consumer，从start开始最多count条
+//返回下一次的start（"0-0"表示已经遍历完）和转移的消息，需要redis 6.2以上
+func (c RedisCache) Xautoclaim(ctx context.Context, key, group, consumer string, minIdle time.Duration, start string, count int) (string, []StreamEntry, error) {
+	values, err := redis.Values(c.DoContext(ctx, "XAUTOCLAIM", key, group, consumer, int64(minIdle/time.Millisecond), start, "COUNT", count))
+	if err != nil {
+		return "", nil, err
+	}
+	if len(values) < 2 {
+		return "", nil, ErrStreamReply
+	}
+	next, err := redis.String(values[0], nil)
+	if err != nil {
+		return "", nil, err
+	}
+	entries, err := parseStreamEntries(key, values[1])
+	return next, entries, err
+}
+
+//列出消费组里还没确认的消息，consumer为空时列出全部消费者的
+func (c RedisCache) Xpending(ctx context.Context, key, group, consumer string, count int) ([]PendingEntry, error) {
+	args := []interface{}{key, group, "-", "+", count}
+	if consumer != "" {
+		args = append(args, consumer)
+	}
+	values, err := redis.Values(c.DoContext(ctx, "XPENDING", args...))
+	if err != nil {
+		return nil, err
+	}
+
+	pending := make([]PendingEntry, 0, len(values))
+	for _, v := range values {
+		var p PendingEntry
+		var idle int64
+		fields, err := redis.Values(v, nil)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := redis.Scan(fields, &p.ID, &p.Consumer, &idle, &p.Deliveries); err != nil {
+			return nil, err
+		}
+		p.Idle = time.Duration(idle) * time.Millisecond
+		pending = append(pending, p)
+	}
+	return pending, nil
+}
+
+//流的长度
+func (c RedisCache) Xlen(ctx context.Context, key string) (int, error) {
+	return redis.Int(c.DoContext(ctx, "XLEN", key))
+}
+
+//删除消息，返回删除的数量
+func (c RedisCache) Xdel(ctx context.Context, key string, ids ...string) (int, error) {
+	args := []interface{}{key}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	return redis.Int(c.DoContext(ctx, "XDEL", args...))
+}
+
+//解析[[id, [field, value, ...]], ...]
+func parseStreamEntries(stream string, reply interface{}) ([]StreamEntry, error) {
+	items, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]StreamEntry, 0, len(items))
+	for _, it := range items {
+		if it == nil {
+			continue
+		}
+		kv, err := redis.Values(it, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(kv) != 2 {
+			return nil, ErrStreamReply
+		}
+		e := StreamEntry{Stream: stream}
+		if e.ID, err = redis.String(kv[0], nil); err != nil {
+			return nil, err
+		}
+		//redis 6.2的XAUTOCLAIM对已经删除的消息返回[id, nil]
+		if kv[1] != nil {
+			if e.Fields, err = redis.StringMap(kv[1], nil); err != nil {
+				return nil, err
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
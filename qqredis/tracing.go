@@ -0,0 +1,43 @@
+package qqredis
+
+import (
+	"context"
+
+	"github.com/garyburd/redigo/redis"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "hallversion/common/qqredis"
+
+//返回开启链路追踪的RedisCache，带ctx的方法（DoContext、EvalContext）会生成client span
+func (c RedisCache) WithTracerProvider(tp trace.TracerProvider) RedisCache {
+	c.tracer = tp.Tracer(tracerName)
+	return c
+}
+
+func (c RedisCache) startSpan(ctx context.Context, cmd string) trace.Span {
+	if c.tracer == nil {
+		return nil
+	}
+	_, span := c.tracer.Start(ctx, cmd,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "redis"),
+			attribute.String("db.operation", cmd),
+		))
+	return span
+}
+
+//结束span，有错误时记录错误（redis.ErrNil不算错误），span为nil时什么都不做
+func EndSpan(span trace.Span, err error) {
+	if span == nil {
+		return
+	}
+	if err != nil && err != redis.ErrNil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,411 @@
+package redisqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/weikaishio/go-logger/logger"
+)
+
+const adminPageSize = 100
+
+var ErrMsgNotFound = errors.New("redisqueue: message not found")
+
+//消息所在的位置
+const (
+	MsgStateReady      = "ready"
+	MsgStateDelayed    = "delayed"
+	MsgStateProcessing = "processing"
+	MsgStateDead       = "dead"
+)
+
+//把一条消息从一个列表移到另一个列表的队首
+var moveScript = redis.NewScript(2, `
+if redis.call('LREM', KEYS[1], 1, ARGV[1]) == 0 then
+	return 0
+end
+redis.call('LPUSH', KEYS[2], ARGV[1])
+return 1
+`)
+
+//从队列里取出并删除最多ARGV[1]条消息（列表或者有序集合），返回删除的消息
+var purgeScript = redis.NewScript(1, `
+local n = tonumber(ARGV[1])
+local t = redis.call('TYPE', KEYS[1]).ok
+local items = {}
+if t == 'list' then
+	items = redis.call('LRANGE', KEYS[1], 0, n - 1)
+	redis.call('LTRIM', KEYS[1], n, -1)
+elseif t == 'zset' then
+	items = redis.call('ZRANGE', KEYS[1], 0, n - 1)
+	redis.call('ZREMRANGEBYRANK', KEYS[1], 0, n - 1)
+end
+return items
+`)
+
+var priorityKeySuffix = regexp.MustCompile(`:p\d+$`)
+
+// 队列统计
+type QueueStats struct {
+	Name       string `json:"name"`
+	Ready      int    `json:"ready"`      //待处理
+	Delayed    int    `json:"delayed"`    //延迟中
+	Processing int    `json:"processing"` //处理中
+	Dead       int    `json:"dead"`       //死信
+	Consumers  int    `json:"consumers"`  //消费者数量
+}
+
+// 查找到的消息
+type FoundMsg struct {
+	Msg   *QueueMsg `json:"msg"`
+	State string    `json:"state"` //消息所在的位置，见MsgStateReady等
+	Key   string    `json:"key"`   //消息所在的redis key
+
+	raw []byte
+}
+
+// 队列管理，不会消费消息
+// 优先级、死信后缀等配置需要和生产者、消费者一致
+type Admin struct {
+	q *RedisQueue
+}
+
+//新建队列管理，q只用来读取配置和redis连接，不需要Start
+func NewAdmin(q *RedisQueue) *Admin {
+	return &Admin{q: q}
+}
+
+//列出前缀为prefix的队列
+func (a *Admin) Queues(prefix string) ([]string, error) {
+	keys, err := a.q.redisclient.Scan(prefix+"*", 1000)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]struct{})
+	names := make([]string, 0)
+	for _, key := range keys {
+		name := a.queueName(key)
+		if name == "" || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+//redis key所属的队列名称
+func (a *Admin) queueName(key string) string {
+	//主题的订阅集合不是队列
+	if strings.HasSuffix(key, ":subscribers") {
+		return ""
+	}
+	//StreamQueue的流和延迟集合，不是list，统计长度时会报WRONGTYPE
+	if strings.HasSuffix(key, ":stream") || strings.HasSuffix(key, ":stream:delayed") {
+		return ""
+	}
+	for _, marker := range []string{":processing:", ":heartbeat:", ":unique:", ":processed:"} {
+		if i := strings.Index(key, marker); i >= 0 {
+			key = key[:i]
+		}
+	}
+	key = strings.TrimSuffix(key, ":consumers")
+	key = strings.TrimSuffix(key, a.q.deadSuffix)
+	key = strings.TrimSuffix(key, ":delayed")
+	if a.q.priorityLevels > 1 {
+		key = priorityKeySuffix.ReplaceAllString(key, "")
+	}
+	return key
+}
+
+//列出前缀为prefix的队列以及长度
+func (a *Admin) QueueStats(prefix string) ([]*QueueStats, error) {
+	names, err := a.Queues(prefix)
+	if err != nil {
+		return nil, err
+	}
+	stats := make([]*QueueStats, 0, len(names))
+	for _, name := range names {
+		st, err := a.Stats(name)
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, st)
+	}
+	return stats, nil
+}
+
+//队列统计
+func (a *Admin) Stats(queuename string) (*QueueStats, error) {
+	rc := a.q.redisclient
+	st := &QueueStats{Name: queuename}
+
+	for _, key := range a.q.readyKeys(queuename) {
+		n, err := rc.Llen(key)
+		if err != nil {
+			return nil, err
+		}
+		st.Ready += n
+
+		n, err = rc.Zcard(delayedKey(key))
+		if err != nil {
+			return nil, err
+		}
+		st.Delayed += n
+	}
+
+	consumers, err := a.consumers(queuename)
+	if err != nil {
+		return nil, err
+	}
+	st.Consumers = len(consumers)
+	for _, consumer := range consumers {
+		n, err := rc.Llen(processingKey(queuename, consumer))
+		if err != nil {
+			return nil, err
+		}
+		st.Processing += n
+	}
+
+	st.Dead, err = rc.Llen(a.q.DeadQueueName(queuename))
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (a *Admin) consumers(queuename string) ([]string, error) {
+	consumers, err := a.q.redisclient.Smembers(consumersKey(queuename))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	return consumers, err
+}
+
+//按出列顺序查看待处理的消息，不会消费消息
+//offset为跳过的数量，count为返回的最大数量
+func (a *Admin) Peek(queuename string, offset, count int) ([]*QueueMsg, error) {
+	rc := a.q.redisclient
+	qms := make([]*QueueMsg, 0, count)
+
+	for _, key := range a.q.readyKeys(queuename) {
+		if count <= 0 {
+			break
+		}
+		n, err := rc.Llen(key)
+		if err != nil {
+			return nil, err
+		}
+		if offset >= n {
+			offset -= n
+			continue
+		}
+
+		//从队尾出列，倒序读取
+		items, err := rc.Lrange(key, -(offset + count), -(offset + 1))
+		if err != nil {
+			return nil, err
+		}
+		for i := len(items) - 1; i >= 0; i-- {
+			if qm := decodeItem(items[i], queuename); qm != nil {
+				qms = append(qms, qm)
+			}
+		}
+		count -= len(items)
+		offset = 0
+	}
+	return qms, nil
+}
+
+func decodeItem(item interface{}, queuename string) *QueueMsg {
+	raw, err := redis.Bytes(item, nil)
+	if err != nil {
+		return nil
+	}
+	qm := new(QueueMsg)
+	if err := decodeMsg(raw, qm); err != nil {
+		logger.LogWarn(fmt.Sprintf("RedisQueue admin unmarshal error: %v, item:%s", err, raw))
+		return nil
+	}
+	qm.raw = raw
+	qm.queue = queuename
+	return qm
+}
+
+//按uuid查找消息，依次查找待处理、延迟、处理中和死信
+func (a *Admin) Find(queuename, guid string) (*FoundMsg, error) {
+	rc := a.q.redisclient
+
+	for _, key := range a.q.readyKeys(queuename) {
+		if fm, err := a.findInList(key, queuename, guid, MsgStateReady); fm != nil || err != nil {
+			return fm, err
+		}
+	}
+
+	for _, key := range a.q.readyKeys(queuename) {
+		dkey := delayedKey(key)
+		for start := 0; ; start += adminPageSize {
+			items, err := rc.Zrange(dkey, start, start+adminPageSize-1)
+			if err != nil {
+				return nil, err
+			}
+			for _, it := range items {
+				if qm := decodeItem(it, queuename); qm != nil && qm.UUID == guid {
+					return &FoundMsg{Msg: qm, State: MsgStateDelayed, Key: dkey, raw: qm.raw}, nil
+				}
+			}
+			if len(items) < adminPageSize {
+				break
+			}
+		}
+	}
+
+	consumers, err := a.consumers(queuename)
+	if err != nil {
+		return nil, err
+	}
+	for _, consumer := range consumers {
+		if fm, err := a.findInList(processingKey(queuename, consumer), queuename, guid, MsgStateProcessing); fm != nil || err != nil {
+			return fm, err
+		}
+	}
+
+	dm, err := a.q.DeadMsg(queuename, guid)
+	if err == ErrDeadMsgNotFound {
+		return nil, ErrMsgNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &FoundMsg{Msg: dm.Msg, State: MsgStateDead, Key: a.q.DeadQueueName(queuename), raw: dm.raw}, nil
+}
+
+func (a *Admin) findInList(key, queuename, guid, state string) (*FoundMsg, error) {
+	for start := 0; ; start += adminPageSize {
+		items, err := a.q.redisclient.Lrange(key, start, start+adminPageSize-1)
+		if err != nil {
+			return nil, err
+		}
+		for _, it := range items {
+			if qm := decodeItem(it, queuename); qm != nil && qm.UUID == guid {
+				return &FoundMsg{Msg: qm, State: state, Key: key, raw: qm.raw}, nil
+			}
+		}
+		if len(items) < adminPageSize {
+			return nil, nil
+		}
+	}
+}
+
+//按uuid删除消息，包括延迟中、处理中的消息和死信
+func (a *Admin) Delete(queuename, guid string) error {
+	fm, err := a.Find(queuename, guid)
+	if err != nil {
+		return err
+	}
+
+	rc := a.q.redisclient
+	switch fm.State {
+	case MsgStateDelayed:
+		_, err = rc.DoContext(context.Background(), "ZREM", fm.Key, fm.raw)
+	case MsgStateProcessing:
+		_, err = rc.Eval(ackScript, fm.Key, processingTsKey(fm.Key), fm.raw)
+	default:
+		err = rc.Lrem(fm.Key, fm.raw)
+	}
+	if err != nil {
+		return err
+	}
+	if fm.Msg != nil {
+		releaseUnique(a.q.redisclient, fm.Msg, queuename)
+	}
+	return nil
+}
+
+//把from里待处理的消息按出列顺序移到to，count<=0时全部移动，返回移动的数量
+//延迟中和处理中的消息不会移动，消息的唯一锁不会迁移
+func (a *Admin) Move(from, to string, count int) (int, error) {
+	moved := 0
+	for level := len(a.q.readyKeys(from)) - 1; level >= 0; level-- {
+		src, dst := a.q.readyKey(from, level), a.q.readyKey(to, level)
+		for count <= 0 || moved < count {
+			item, err := a.q.redisclient.DoContext(context.Background(), "RPOPLPUSH", src, dst)
+			if err != nil {
+				return moved, err
+			}
+			if item == nil {
+				break
+			}
+			moved++
+		}
+	}
+	return moved, nil
+}
+
+//按uuid把一条待处理的消息从from移到to
+func (a *Admin) MoveMsg(from, to, guid string) error {
+	for _, key := range a.q.readyKeys(from) {
+		fm, err := a.findInList(key, from, guid, MsgStateReady)
+		if err != nil {
+			return err
+		}
+		if fm == nil {
+			continue
+		}
+		n, err := redis.Int(a.q.redisclient.Eval(moveScript, key, a.q.readyKey(to, fm.Msg.Weight), fm.raw))
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrMsgNotFound
+		}
+		return nil
+	}
+	return ErrMsgNotFound
+}
+
+//清空队列里待处理和延迟中的消息，返回删除的数量，处理中的消息和死信不受影响
+//删除的消息持有的唯一锁（WithUniqueKey）会被释放，之后可以重新入列
+func (a *Admin) Purge(queuename string) (int, error) {
+	total := 0
+	for _, key := range a.q.readyKeys(queuename) {
+		for _, k := range []string{key, delayedKey(key)} {
+			n, err := a.purge(k, queuename)
+			total += n
+			if err != nil {
+				return total, err
+			}
+		}
+	}
+	return total, nil
+}
+
+//分批删除一个key里的消息并释放唯一锁
+func (a *Admin) purge(key, queuename string) (int, error) {
+	total := 0
+	for {
+		items, err := redis.Values(a.q.redisclient.Eval(purgeScript, key, adminPageSize))
+		if err != nil {
+			return total, err
+		}
+		for _, it := range items {
+			if qm := decodeItem(it, queuename); qm != nil {
+				releaseUnique(a.q.redisclient, qm, queuename)
+			}
+		}
+		total += len(items)
+		if len(items) < adminPageSize {
+			return total, nil
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package redisqueue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdminStats(t *testing.T) {
+	_, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, "", WithRetryPolicy(RetryPolicy{}))
+	a := NewAdmin(q)
+
+	for i := 0; i < 3; i++ {
+		EnQueueTask(q, map[string]interface{}{"n": i}, 1, 0, "aq")
+	}
+	delayed, _ := NewQueueMsg(map[string]interface{}{"n": 3}, 1, 0)
+	q.EnQueueIn(delayed, "aq", time.Hour)
+	_, qm, _ := q.DeQueue("aq")
+	FailQueueTask(q, qm, "aq", nil)
+	q.DeQueue("aq")
+
+	st, err := a.Stats("aq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Ready != 1 || st.Delayed != 1 || st.Processing != 1 || st.Dead != 1 || st.Consumers != 1 {
+		t.Errorf("stats = %+v", st)
+	}
+	names, _ := a.Queues("")
+	if len(names) != 1 || names[0] != "aq" {
+		t.Errorf("queues = %v, want [aq]", names)
+	}
+}
+
+func TestAdminFind(t *testing.T) {
+	_, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, "")
+	a := NewAdmin(q)
+
+	ready, _ := EnQueueTask(q, map[string]interface{}{"n": 1}, 1, 0, "aq")
+	delayed, _ := NewQueueMsg(map[string]interface{}{"n": 2}, 1, 0)
+	q.EnQueueIn(delayed, "aq", time.Hour)
+	processing, _ := EnQueueTask(q, map[string]interface{}{"n": 3}, 1, 0, "pq")
+	q.DeQueue("pq")
+	dead := deadLetterOne(t, q, "dq")
+
+	for _, c := range []struct {
+		queue, guid, state string
+	}{
+		{"aq", ready, MsgStateReady},
+		{"aq", delayed.UUID, MsgStateDelayed},
+		{"pq", processing, MsgStateProcessing},
+		{"dq", dead, MsgStateDead},
+	} {
+		fm, err := a.Find(c.queue, c.guid)
+		if err != nil || fm.State != c.state || fm.Msg.UUID != c.guid {
+			t.Errorf("Find(%s) = %+v, %v, want %s", c.state, fm, err, c.state)
+			continue
+		}
+		if err := a.Delete(c.queue, c.guid); err != nil {
+			t.Errorf("Delete(%s): %v", c.state, err)
+		}
+		if _, err := a.Find(c.queue, c.guid); err != ErrMsgNotFound {
+			t.Errorf("Find(%s) after delete err = %v, want ErrMsgNotFound", c.state, err)
+		}
+	}
+}
+
+func TestAdminMove(t *testing.T) {
+	_, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, "", WithPriorityLevels(2))
+	a := NewAdmin(q)
+
+	var guids []string
+	for i := 0; i < 4; i++ {
+		guid, _ := EnQueueTask(q, map[string]interface{}{"n": i}, i%2, 0, "from")
+		guids = append(guids, guid)
+	}
+
+	if err := a.MoveMsg("from", "to", guids[2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.MoveMsg("from", "to", "missing"); err != ErrMsgNotFound {
+		t.Errorf("MoveMsg missing err = %v, want ErrMsgNotFound", err)
+	}
+	if n, err := a.Move("from", "to", 2); n != 2 || err != nil {
+		t.Fatalf("Move = %d, %v, want 2", n, err)
+	}
+	if n, err := a.Move("from", "to", 0); n != 1 || err != nil {
+		t.Fatalf("Move all = %d, %v, want 1", n, err)
+	}
+
+	//移动后保留优先级
+	var got []string
+	for i := 0; i < 4; i++ {
+		_, qm, _ := q.DeQueue("to")
+		if qm == nil {
+			t.Fatalf("to has %d messages, want 4", i)
+		}
+		got = append(got, qm.UUID)
+	}
+	if got[0] != guids[1] || got[1] != guids[3] {
+		t.Errorf("order = %v, want the high priority messages %s,%s first", got, guids[1], guids[3])
+	}
+	if st, _ := a.Stats("from"); st.Ready != 0 {
+		t.Errorf("from ready = %d, want 0", st.Ready)
+	}
+}
+
+func TestAdminPurge(t *testing.T) {
+	s, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, "")
+	a := NewAdmin(q)
+
+	for i := 0; i < adminPageSize+5; i++ {
+		EnQueueTask(q, map[string]interface{}{"n": i}, 1, 0, "aq")
+	}
+	EnQueueTask(q, map[string]interface{}{"n": 1}, 1, 0, "aq", WithUniqueKey("u1", 0))
+	delayed, _ := NewQueueMsg(map[string]interface{}{"n": 2}, 1, 0, WithUniqueKey("u2", 0))
+	q.EnQueueIn(delayed, "aq", time.Hour)
+	EnQueueTask(q, map[string]interface{}{"n": 3}, 1, 0, "aq")
+	_, processing, _ := q.DeQueue("aq")
+
+	n, err := a.Purge("aq")
+	if n != adminPageSize+7 || err != nil {
+		t.Fatalf("Purge = %d, %v, want %d", n, err, adminPageSize+7)
+	}
+	if s.Exists("aq") || s.Exists(delayedKey("aq")) {
+		t.Error("ready or delayed key left after purge")
+	}
+	if st, _ := a.Stats("aq"); st.Processing != 1 {
+		t.Errorf("processing = %d, want 1", st.Processing)
+	}
+	if err := q.Ack(processing); err != nil {
+		t.Error(err)
+	}
+
+	//删除的消息的唯一锁已经释放
+	for _, key := range []string{"u1", "u2"} {
+		if _, err := EnQueueTask(q, map[string]interface{}{"n": 4}, 1, 0, "aq", WithUniqueKey(key, 0)); err != nil {
+			t.Errorf("enqueue %s after purge: %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package redisqueue
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeMsgpack  = "application/x-msgpack"
+	ContentTypeProtobuf = "application/x-protobuf"
+	ContentTypeGob      = "application/x-gob"
+)
+
+var ErrUnknownContentType = errors.New("redisqueue: unknown content type")
+
+// 消息的编码方式
+//除json外，编码后的数据前面会加上 \x00+ContentType+\n 的标记，消费者按标记选择解码方式
+//json不加标记，旧版本的消费者也能解析
+type Codec interface {
+	ContentType() string
+	Marshal(qm *QueueMsg) ([]byte, error)
+	Unmarshal(data []byte, qm *QueueMsg) error
+}
+
+var (
+	JSONCodec     Codec = jsonCodec{}
+	MsgpackCodec  Codec = msgpackCodec{}
+	ProtobufCodec Codec = protobufCodec{}
+	GobCodec      Codec = gobCodec{}
+)
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{}
+)
+
+func init() {
+	RegisterCodec(JSONCodec)
+	RegisterCodec(MsgpackCodec)
+	RegisterCodec(ProtobufCodec)
+	RegisterCodec(GobCodec)
+}
+
+//注册编码方式，用于按ContentType解码
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	codecs[c.ContentType()] = c
+	codecsMu.Unlock()
+}
+
+func codecByType(contentType string) (Codec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[contentType]
+	return c, ok
+}
+
+//编码消息，加上ContentType标记
+func encodeMsg(c Codec, qm *QueueMsg) ([]byte, error) {
+	bt, err := c.Marshal(qm)
+	if err != nil || c.ContentType() == ContentTypeJSON {
+		return bt, err
+	}
+
+	ct := c.ContentType()
+	data := make([]byte, 0, len(ct)+2+len(bt))
+	data = append(data, 0)
+	data = append(data, ct...)
+	data = append(data, '\n')
+	return append(data, bt...), nil
+}
+
+//按ContentType标记解码消息，没有标记的按json解码，旧版本以秒保存的时间会转换成毫秒
+func decodeMsg(data []byte, qm *QueueMsg) error {
+	c, data, err := splitContentType(data)
+	if err != nil {
+		return err
+	}
+	if err := c.Unmarshal(data, qm); err != nil {
+		return err
+	}
+	normalizeMsgTime(qm)
+	return nil
+}
+
+//根据内容类型标记找到编码方式，没有标记的是json
+func splitContentType(data []byte) (Codec, []byte, error) {
+	if len(data) == 0 || data[0] != 0 {
+		return JSONCodec, data, nil
+	}
+
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		return nil, nil, ErrUnknownContentType
+	}
+	c, ok := codecByType(string(data[1:i]))
+	if !ok {
+		return nil, nil, ErrUnknownContentType
+	}
+	return c, data[i+1:], nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string { return ContentTypeJSON }
+
+func (jsonCodec) Marshal(qm *QueueMsg) ([]byte, error) {
+	return json.Marshal(qm)
+}
+
+func (jsonCodec) Unmarshal(data []byte, qm *QueueMsg) error {
+	return json.Unmarshal(data, qm)
+}
+
+//msgpack，字段名沿用json标签，map按key排序
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string { return ContentTypeMsgpack }
+
+func (msgpackCodec) Marshal(qm *QueueMsg) ([]byte, error) {
+	var b bytes.Buffer
+	enc := msgpack.NewEncoder(&b)
+	enc.SetCustomStructTag("json")
+	enc.SetSortMapKeys(true)
+	if err := enc.Encode(qm); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, qm *QueueMsg) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(qm)
+}
+
+//gob，Msg里的自定义类型需要先调用Register注册
+type gobCodec struct{}
+
+func (gobCodec) ContentType() string { return ContentTypeGob }
+
+func (gobCodec) Marshal(qm *QueueMsg) ([]byte, error) {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(qm); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, qm *QueueMsg) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(qm)
+}
+
+//protobuf，消息定义见queuemsg.proto
+//编码结果是确定的（消息头按key排序），LREM/ZREM按原始数据匹配消息
+type protobufCodec struct{}
+
+func (protobufCodec) ContentType() string { return ContentTypeProtobuf }
+
+func (protobufCodec) Marshal(qm *QueueMsg) ([]byte, error) {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, qm.UUID)
+
+	if qm.Msg != nil {
+		st, err := structpb.NewStruct(qm.Msg)
+		if err != nil {
+			return nil, err
+		}
+		msg, err := proto.MarshalOptions{Deterministic: true}.Marshal(st)
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, msg)
+	}
+	if qm.Body != nil {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendBytes(b, qm.Body)
+	}
+	if qm.UniqueKey != "" {
+		b = protowire.AppendTag(b, 9, protowire.BytesType)
+		b = protowire.AppendString(b, qm.UniqueKey)
+	}
+	keys := make([]string, 0, len(qm.Headers))
+	for k := range qm.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		//map的每一项是一个key=1、value=2的子消息
+		var entry []byte
+		entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+		entry = protowire.AppendString(entry, k)
+		entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+		entry = protowire.AppendString(entry, qm.Headers[k])
+		b = protowire.AppendTag(b, 12, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+
+	for _, f := range []struct {
+		num protowire.Number
+		v   int64
+	}{
+		{4, qm.Createdtime},
+		{5, qm.DeadTime},
+		{6, int64(qm.Weight)},
+		{7, int64(qm.Retry)},
+		{8, int64(qm.Attempt)},
+		{10, qm.UniqueTTL},
+		{11, qm.ExecTimeout},
+	} {
+		b = protowire.AppendTag(b, f.num, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(f.v))
+	}
+	return b, nil
+}
+
+func (protobufCodec) Unmarshal(data []byte, qm *QueueMsg) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		switch {
+		case typ == protowire.BytesType && (num <= 3 || num == 9 || num == 12):
+			v, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+			switch num {
+			case 1:
+				qm.UUID = string(v)
+			case 2:
+				st := new(structpb.Struct)
+				if err := proto.Unmarshal(v, st); err != nil {
+					return err
+				}
+				qm.Msg = st.AsMap()
+			case 3:
+				qm.Body = append(json.RawMessage(nil), v...)
+			case 9:
+				qm.UniqueKey = string(v)
+			case 12:
+				k, v, err := unmarshalMapEntry(v)
+				if err != nil {
+					return err
+				}
+				if qm.Headers == nil {
+					qm.Headers = make(map[string]string)
+				}
+				qm.Headers[k] = v
+			}
+		case typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+			switch num {
+			case 4:
+				qm.Createdtime = int64(v)
+			case 5:
+				qm.DeadTime = int64(v)
+			case 6:
+				qm.Weight = int(int64(v))
+			case 7:
+				qm.Retry = int(int64(v))
+			case 8:
+				qm.Attempt = int(int64(v))
+			case 10:
+				qm.UniqueTTL = int64(v)
+			case 11:
+				qm.ExecTimeout = int64(v)
+			}
+		default:
+			//不认识的字段跳过，兼容新版本增加的字段
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+		}
+	}
+	return nil
+}
+
+//解析map<string, string>的一项
+func unmarshalMapEntry(data []byte) (key, value string, err error) {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return "", "", protowire.ParseError(n)
+		}
+		data = data[n:]
+		if typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		} else {
+			var v []byte
+			v, n = protowire.ConsumeBytes(data)
+			switch num {
+			case 1:
+				key = string(v)
+			case 2:
+				value = string(v)
+			}
+		}
+		if n < 0 {
+			return "", "", protowire.ParseError(n)
+		}
+		data = data[n:]
+	}
+	return key, value, nil
+}
@@ -0,0 +1,198 @@
+package redisqueue
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+func newCodecTestMsg(t *testing.T) *QueueMsg {
+	qm, err := NewQueueMsg(map[string]interface{}{
+		"cmd":   "create_table",
+		"queue": "11111111",
+		"seats": []interface{}{"a", "b"},
+		"opts":  map[string]interface{}{"private": true},
+	}, 2, 3, WithUniqueKey("create_table:12", time.Minute), WithExecTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("NewQueueMsg: %v", err)
+	}
+	qm.Body = json.RawMessage(`{"table_id":12}`)
+	qm.Attempt = 1
+	qm.Headers = map[string]string{"tenant": "t1", "traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}
+	qm.DeadTime = -1
+	return qm
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, c := range []Codec{JSONCodec, MsgpackCodec, ProtobufCodec, GobCodec} {
+		want := newCodecTestMsg(t)
+
+		data, err := encodeMsg(c, want)
+		if err != nil {
+			t.Fatalf("%s: encode: %v", c.ContentType(), err)
+		}
+
+		got := new(QueueMsg)
+		if err := decodeMsg(data, got); err != nil {
+			t.Fatalf("%s: decode: %v", c.ContentType(), err)
+		}
+
+		if got.UUID != want.UUID || got.Createdtime != want.Createdtime || got.DeadTime != want.DeadTime ||
+			got.Weight != want.Weight || got.Retry != want.Retry || got.Attempt != want.Attempt ||
+			got.UniqueKey != want.UniqueKey || got.UniqueTTL != want.UniqueTTL || got.ExecTimeout != want.ExecTimeout {
+			t.Errorf("%s: got %#v, want %#v", c.ContentType(), got, want)
+		}
+		if !reflect.DeepEqual(got.Headers, want.Headers) {
+			t.Errorf("%s: headers = %v, want %v", c.ContentType(), got.Headers, want.Headers)
+		}
+		if string(got.Body) != string(want.Body) {
+			t.Errorf("%s: body = %s, want %s", c.ContentType(), got.Body, want.Body)
+		}
+		if got.Msg["cmd"] != "create_table" || !reflect.DeepEqual(got.Msg["seats"], []interface{}{"a", "b"}) {
+			t.Errorf("%s: msg = %#v", c.ContentType(), got.Msg)
+		}
+	}
+}
+
+func TestCodecJSONUnmarked(t *testing.T) {
+	qm := newCodecTestMsg(t)
+
+	data, err := encodeMsg(JSONCodec, qm)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if data[0] != '{' {
+		t.Errorf("json should not be marked, got %q", data[:10])
+	}
+
+	//旧版本直接json.Marshal的消息
+	old, _ := json.Marshal(qm)
+	got := new(QueueMsg)
+	if err := decodeMsg(old, got); err != nil || got.UUID != qm.UUID {
+		t.Errorf("decode legacy json: %v, %#v", err, got)
+	}
+}
+
+func TestCodecUnknownContentType(t *testing.T) {
+	data := append([]byte("\x00application/x-unknown\n"), "xxx"...)
+
+	if err := decodeMsg(data, new(QueueMsg)); err != ErrUnknownContentType {
+		t.Errorf("err = %v, want ErrUnknownContentType", err)
+	}
+}
+
+func TestCodecDeterministic(t *testing.T) {
+	qm := newCodecTestMsg(t)
+	for i := 0; i < 20; i++ {
+		qm.Headers[string(rune('a'+i))] = "v"
+	}
+
+	for _, c := range []Codec{JSONCodec, MsgpackCodec, ProtobufCodec} {
+		first, err := encodeMsg(c, qm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			if data, _ := encodeMsg(c, qm); string(data) != string(first) {
+				t.Fatalf("%s: encoding is not deterministic", c.ContentType())
+			}
+		}
+	}
+}
+
+//按queuemsg.proto构造的消息定义
+func queueMsgDescriptor(t *testing.T) protoreflect.MessageDescriptor {
+	field := func(name string, num int32, typ descriptorpb.FieldDescriptorProto_Type, label descriptorpb.FieldDescriptorProto_Label, typeName string) *descriptorpb.FieldDescriptorProto {
+		f := &descriptorpb.FieldDescriptorProto{Name: proto.String(name), Number: proto.Int32(num), Type: typ.Enum(), Label: label.Enum(), JsonName: proto.String(name)}
+		if typeName != "" {
+			f.TypeName = proto.String(typeName)
+		}
+		return f
+	}
+	opt, rep := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL, descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+	str, i64 := descriptorpb.FieldDescriptorProto_TYPE_STRING, descriptorpb.FieldDescriptorProto_TYPE_INT64
+	msg := descriptorpb.FieldDescriptorProto_TYPE_MESSAGE
+
+	fd := &descriptorpb.FileDescriptorProto{
+		Name:       proto.String("queuemsg.proto"),
+		Package:    proto.String("redisqueue"),
+		Syntax:     proto.String("proto3"),
+		Dependency: []string{"google/protobuf/struct.proto"},
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("QueueMsg"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				field("uuid", 1, str, opt, ""),
+				field("msg", 2, msg, opt, ".google.protobuf.Struct"),
+				field("body", 3, descriptorpb.FieldDescriptorProto_TYPE_BYTES, opt, ""),
+				field("create_time", 4, i64, opt, ""),
+				field("dead_time", 5, i64, opt, ""),
+				field("weight", 6, i64, opt, ""),
+				field("retry", 7, i64, opt, ""),
+				field("attempt", 8, i64, opt, ""),
+				field("unique_key", 9, str, opt, ""),
+				field("unique_ttl", 10, i64, opt, ""),
+				field("exec_timeout", 11, i64, opt, ""),
+				field("headers", 12, msg, rep, ".redisqueue.QueueMsg.HeadersEntry"),
+			},
+			NestedType: []*descriptorpb.DescriptorProto{{
+				Name:    proto.String("HeadersEntry"),
+				Field:   []*descriptorpb.FieldDescriptorProto{field("key", 1, str, opt, ""), field("value", 2, str, opt, "")},
+				Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+			}},
+		}},
+	}
+	file, err := protodesc.NewFile(fd, protoregistry.GlobalFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file.Messages().ByName("QueueMsg")
+}
+
+func TestProtobufCodecSchema(t *testing.T) {
+	qm := newCodecTestMsg(t)
+	data, err := ProtobufCodec.Marshal(qm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//按.proto定义解析，确认手写的编码和定义一致
+	m := dynamicpb.NewMessage(queueMsgDescriptor(t))
+	if err := (proto.UnmarshalOptions{DiscardUnknown: false}).Unmarshal(data, m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.GetUnknown()) != 0 {
+		t.Errorf("unknown fields: %x", m.GetUnknown())
+	}
+	get := func(name string) protoreflect.Value {
+		return m.Get(m.Descriptor().Fields().ByName(protoreflect.Name(name)))
+	}
+	if get("uuid").String() != qm.UUID || get("retry").Int() != int64(qm.Retry) || get("dead_time").Int() != qm.DeadTime ||
+		get("unique_key").String() != qm.UniqueKey || string(get("body").Bytes()) != string(qm.Body) {
+		t.Errorf("decoded %v", m)
+	}
+	headers := get("headers").Map()
+	if headers.Len() != len(qm.Headers) || headers.Get(protoreflect.ValueOfString("tenant").MapKey()).String() != "t1" {
+		t.Errorf("headers = %v", headers)
+	}
+
+	//反过来用标准库编码，手写的解码能读
+	std, err := proto.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := new(QueueMsg)
+	if err := ProtobufCodec.Unmarshal(std, got); err != nil {
+		t.Fatal(err)
+	}
+	if got.UUID != qm.UUID || !reflect.DeepEqual(got.Headers, qm.Headers) || got.Msg["cmd"] != "create_table" {
+		t.Errorf("got %#v", got)
+	}
+}
@@ -0,0 +1,72 @@
+package redisqueue
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDeQueueContextDeadline(t *testing.T) {
+	_, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, "")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, qm, err := q.DeQueueContext(ctx, "cq")
+	if qm != nil || err != context.DeadlineExceeded {
+		t.Fatalf("DeQueueContext = %+v, %v, want context.DeadlineExceeded", qm, err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("returned after %v, want about the deadline", d)
+	}
+}
+
+func TestDeQueueContextCancel(t *testing.T) {
+	_, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, qm, err := q.DeQueueContext(ctx, "cq"); qm != nil || err != context.Canceled {
+		t.Errorf("DeQueueContext = %+v, %v, want context.Canceled", qm, err)
+	}
+	if _, err := EnQueueTaskContext(ctx, q, map[string]interface{}{"n": 1}, 1, 0, "cq"); err != context.Canceled {
+		t.Errorf("EnQueueTaskContext err = %v, want context.Canceled", err)
+	}
+	if n, _ := rc.Llen("cq"); n != 0 {
+		t.Errorf("ready = %d, want 0", n)
+	}
+}
+
+func TestGetQueueMsgContext(t *testing.T) {
+	_, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, "cq")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if qm, _, err := DeQueueTaskContext(ctx, q); qm != nil || err != context.DeadlineExceeded {
+		t.Errorf("DeQueueTaskContext = %+v, %v, want context.DeadlineExceeded", qm, err)
+	}
+
+	//队列退出后返回nil
+	q.Quit()
+	if qm, _, err := q.GetQueueMsgContext(context.Background()); qm != nil || err != nil {
+		t.Errorf("after quit = %+v, %v, want nil", qm, err)
+	}
+}
+
+func TestDeQueueContextMessage(t *testing.T) {
+	_, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, "")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		EnQueueTask(q, map[string]interface{}{"n": 1}, 1, 0, "cq")
+	}()
+	if _, qm, err := q.DeQueueContext(ctx, "cq"); qm == nil || err != nil {
+		t.Errorf("DeQueueContext = %+v, %v, want the message", qm, err)
+	}
+}
@@ -0,0 +1,246 @@
+package redisqueue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/garyburd/redigo/redis"
+	"hallversion/common/qqredis"
+)
+
+const (
+	DefaultDeadLetterSuffix = ":dead" //死信队列的后缀
+
+	DeadReasonRetryExhausted = "retry_exhausted" //重试次数用完
+	DeadReasonExpired        = "expired"         //消息过期
+	DeadReasonMalformed      = "malformed"       //消息没有消息体
+)
+
+var (
+	ErrDeadMsgNotFound = errors.New("redisqueue: dead message not found")
+	ErrMsgExpired      = errors.New("redisqueue: message expired")
+)
+
+//死信每页读取的条数
+const deadPageSize = 100
+
+//从处理中列表删除并写入死信队列，消息不在处理中列表时不写入
+var deadLetterScript = redis.NewScript(3, `
+if redis.call('LREM', KEYS[1], 1, ARGV[1]) == 0 then
+	return 0
+end
+redis.call('ZREM', KEYS[2], ARGV[1])
+redis.call('LPUSH', KEYS[3], ARGV[2])
+return 1
+`)
+
+//从死信队列移回原队列
+var requeueDeadScript = redis.NewScript(2, `
+if redis.call('LREM', KEYS[1], 1, ARGV[1]) == 0 then
+	return 0
+end
+redis.call('LPUSH', KEYS[2], ARGV[2])
+return 1
+`)
+
+// 死信队列里的消息
+type DeadMsg struct {
+	Msg       *QueueMsg `json:"msg"`        //原始消息
+	Queue     string    `json:"queue"`      //来源队列
+	Reason    string    `json:"reason"`     //进入死信队列的原因
+	LastError string    `json:"last_error"` //最后一次处理的错误
+	DeadTime  int64     `json:"dead_time"`  //进入死信队列的时间（毫秒）
+
+	raw []byte
+}
+
+//新建死信记录
+func newDeadMsg(qm *QueueMsg, queuename, reason string, cause error) *DeadMsg {
+	dm := &DeadMsg{
+		Msg:      qm,
+		Queue:    queuename,
+		Reason:   reason,
+		DeadTime: nowMillis(),
+	}
+	if cause != nil {
+		dm.LastError = cause.Error()
+	}
+	return dm
+}
+
+//死信队列名称
+func (q *RedisQueue) DeadQueueName(queuename string) string {
+	return queuename + q.deadSuffix
+}
+
+//消息进入死信队列
+func (q *RedisQueue) DeadLetter(qm *QueueMsg, queuename, reason string, cause error) error {
+	if qm == nil {
+		return nil
+	}
+
+	q.untrack(qm)
+
+	bt, err := json.Marshal(newDeadMsg(qm, queuename, reason, cause))
+	if err != nil {
+		return err
+	}
+
+	if pkey := qm.processing; pkey == "" {
+		//没有经过处理中列表的消息直接写入
+		if _, err := q.redisclient.DoContext(msgContext(qm), "LPUSH", q.DeadQueueName(queuename), bt); err != nil {
+			return err
+		}
+	} else {
+		moved, err := redis.Int(q.redisclient.EvalContext(msgContext(qm), deadLetterScript, pkey, processingTsKey(pkey), q.DeadQueueName(queuename), qm.raw, bt))
+		if err != nil {
+			return err
+		}
+		if moved == 0 {
+			return ErrNotInFlight
+		}
+	}
+	releaseUnique(q.redisclient, qm, queuename)
+	if reason == DeadReasonExpired {
+		q.metrics.IncExpired(queuename)
+	}
+	q.metrics.IncDeadLettered(queuename, reason)
+	return nil
+}
+
+//死信数量
+func (q *RedisQueue) DeadCount(queuename string) (int, error) {
+	return q.redisclient.Llen(q.DeadQueueName(queuename))
+}
+
+//列出死信，start/stop同LRANGE，最新的在最前面
+func (q *RedisQueue) DeadMsgs(queuename string, start, stop int) ([]*DeadMsg, error) {
+	return readDeadMsgs(q.redisclient, q.DeadQueueName(queuename), start, stop)
+}
+
+//按uuid查找死信
+func (q *RedisQueue) DeadMsg(queuename, guid string) (*DeadMsg, error) {
+	return findDeadMsg(q.redisclient, q.DeadQueueName(queuename), guid)
+}
+
+//把死信重新放回原队列，retry为重新设置的重试次数
+func (q *RedisQueue) RequeueDead(queuename, guid string, retry int) error {
+	dm, err := q.DeadMsg(queuename, guid)
+	if err != nil {
+		return err
+	}
+	return q.requeueDead(queuename, dm, retry)
+}
+
+//把全部死信重新放回原队列
+func (q *RedisQueue) RequeueAllDead(queuename string, retry int) (int, error) {
+	count := 0
+	for {
+		dms, err := q.DeadMsgs(queuename, -deadPageSize, -1)
+		if err != nil {
+			return count, err
+		}
+		if len(dms) == 0 {
+			return count, nil
+		}
+		//从最旧的开始放回
+		for i := len(dms) - 1; i >= 0; i-- {
+			err := q.requeueDead(queuename, dms[i], retry)
+			if err == ErrDeadMsgNotFound {
+				continue
+			}
+			if err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+}
+
+func (q *RedisQueue) requeueDead(queuename string, dm *DeadMsg, retry int) error {
+	if dm.Msg == nil {
+		//损坏的死信没法放回，直接删掉
+		_, err := q.redisclient.DoContext(context.Background(), "LREM", q.DeadQueueName(queuename), 1, dm.raw)
+		return err
+	}
+
+	qm := dm.Msg
+	qm.Retry = retry
+	refreshDeadTime(qm)
+
+	bt, err := encodeMsg(q.codecFor(queuename), qm)
+	if err != nil {
+		return err
+	}
+
+	moved, err := redis.Int(q.redisclient.Eval(requeueDeadScript, q.DeadQueueName(queuename), q.readyKey(queuename, qm.Weight), dm.raw, bt))
+	if err != nil {
+		return err
+	}
+	if moved == 0 {
+		return ErrDeadMsgNotFound
+	}
+	return nil
+}
+
+//删除一条死信
+func (q *RedisQueue) DeleteDead(queuename, guid string) error {
+	dm, err := q.DeadMsg(queuename, guid)
+	if err != nil {
+		return err
+	}
+	_, err = q.redisclient.DoContext(context.Background(), "LREM", q.DeadQueueName(queuename), 1, dm.raw)
+	return err
+}
+
+//清空死信队列
+func (q *RedisQueue) PurgeDead(queuename string) error {
+	err := q.redisclient.Delete(q.DeadQueueName(queuename))
+	if err == qqredis.ErrCacheMiss {
+		return nil
+	}
+	return err
+}
+
+func readDeadMsgs(rc qqredis.RedisCache, key string, start, stop int) ([]*DeadMsg, error) {
+	items, err := rc.Lrange(key, start, stop)
+	if err != nil {
+		return nil, err
+	}
+
+	dms := make([]*DeadMsg, 0, len(items))
+	for _, it := range items {
+		raw, err := redis.Bytes(it, nil)
+		if err != nil {
+			continue
+		}
+		dm := new(DeadMsg)
+		if err := json.Unmarshal(raw, dm); err != nil {
+			dm.LastError = fmt.Sprintf("unmarshal dead message error: %v", err)
+		} else if dm.Msg != nil {
+			normalizeMsgTime(dm.Msg)
+		}
+		dm.raw = raw
+		dms = append(dms, dm)
+	}
+	return dms, nil
+}
+
+func findDeadMsg(rc qqredis.RedisCache, key, guid string) (*DeadMsg, error) {
+	for start := 0; ; start += deadPageSize {
+		dms, err := readDeadMsgs(rc, key, start, start+deadPageSize-1)
+		if err != nil {
+			return nil, err
+		}
+		for _, dm := range dms {
+			if dm.Msg != nil && dm.Msg.UUID == guid {
+				return dm, nil
+			}
+		}
+		if len(dms) < deadPageSize {
+			return nil, ErrDeadMsgNotFound
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package redisqueue
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+//出列后直接进入死信队列
+func deadLetterOne(t *testing.T, q *RedisQueue, queuename string, opts ...MsgOption) string {
+	t.Helper()
+	guid, err := EnQueueTask(q, map[string]interface{}{"n": 1}, 1, 0, queuename, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, qm, _ := q.DeQueue(queuename)
+	if qm == nil || qm.UUID != guid {
+		t.Fatalf("dequeued %+v, want %s", qm, guid)
+	}
+	FailQueueTask(q, qm, queuename, errors.New("boom"))
+	return guid
+}
+
+func TestDeadLetter(t *testing.T) {
+	_, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, "")
+
+	guid := deadLetterOne(t, q, "dl")
+	if n, ts := inProcessing(t, q, "dl"); n != 0 || ts != 0 {
+		t.Errorf("processing = %d, ts = %d, want 0", n, ts)
+	}
+	if n, _ := q.DeadCount("dl"); n != 1 {
+		t.Fatalf("dead count = %d, want 1", n)
+	}
+	dm, err := q.DeadMsg("dl", guid)
+	if err != nil || dm.Queue != "dl" || dm.Reason != DeadReasonRetryExhausted || dm.LastError != "boom" {
+		t.Fatalf("dead msg = %+v, %v", dm, err)
+	}
+	if _, err := q.DeadMsg("dl", "missing"); err != ErrDeadMsgNotFound {
+		t.Errorf("missing err = %v, want ErrDeadMsgNotFound", err)
+	}
+}
+
+func TestRequeueDead(t *testing.T) {
+	s, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, "")
+
+	guid := deadLetterOne(t, q, "dl", WithTTL(time.Minute))
+	if err := q.RequeueDead("dl", guid, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.RequeueDead("dl", guid, 3); err != ErrDeadMsgNotFound {
+		t.Errorf("requeue twice err = %v, want ErrDeadMsgNotFound", err)
+	}
+	if n, _ := q.DeadCount("dl"); n != 0 {
+		t.Errorf("dead count = %d, want 0", n)
+	}
+
+	_, qm, _ := q.DeQueue("dl")
+	if qm == nil || qm.UUID != guid || qm.Retry != 3 {
+		t.Fatalf("requeued %+v", qm)
+	}
+	if ttl := qm.DeadTime - qm.Createdtime; ttl != int64(time.Minute/time.Millisecond) {
+		t.Errorf("ttl = %d, want one minute", ttl)
+	}
+
+	//多次放回后有效期不会累加
+	time.Sleep(5 * time.Millisecond)
+	qm.Retry = 0
+	FailQueueTask(q, qm, "dl", errors.New("boom"))
+	if err := q.RequeueDead("dl", guid, 0); err != nil {
+		t.Fatal(err)
+	}
+	items, _ := s.List("dl")
+	got := new(QueueMsg)
+	if len(items) != 1 || decodeMsg([]byte(items[0]), got) != nil {
+		t.Fatalf("ready = %v", items)
+	}
+	if remain := got.DeadTime - nowMillis(); remain > int64(time.Minute/time.Millisecond) {
+		t.Errorf("remaining ttl = %dms, want at most one minute", remain)
+	}
+}
+
+func TestRequeueAllDead(t *testing.T) {
+	_, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, "")
+
+	first := deadLetterOne(t, q, "dl")
+	second := deadLetterOne(t, q, "dl")
+	n, err := q.RequeueAllDead("dl", 1)
+	if n != 2 || err != nil {
+		t.Fatalf("requeue all = %d, %v, want 2", n, err)
+	}
+
+	//按进入死信队列的顺序放回
+	for _, want := range []string{first, second} {
+		_, qm, _ := q.DeQueue("dl")
+		if qm == nil || qm.UUID != want || qm.Retry != 1 {
+			t.Errorf("dequeued %+v, want %s", qm, want)
+		}
+	}
+}
+
+func TestDeleteDead(t *testing.T) {
+	_, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, "")
+
+	first := deadLetterOne(t, q, "dl")
+	second := deadLetterOne(t, q, "dl")
+	if err := q.DeleteDead("dl", first); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.DeleteDead("dl", first); err != ErrDeadMsgNotFound {
+		t.Errorf("delete twice err = %v, want ErrDeadMsgNotFound", err)
+	}
+	dms, _ := q.DeadMsgs("dl", 0, -1)
+	if len(dms) != 1 || dms[0].Msg.UUID != second {
+		t.Fatalf("dead = %+v", dms)
+	}
+
+	if err := q.PurgeDead("dl"); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := q.DeadCount("dl"); n != 0 {
+		t.Errorf("dead count = %d, want 0", n)
+	}
+}
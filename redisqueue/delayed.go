@@ -0,0 +1,111 @@
+package redisqueue
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/weikaishio/go-logger/logger"
+	"hallversion/common/qqredis"
+)
+
+const (
+	DefaultPromoteInterval = time.Second //检查到期消息的间隔
+	promoteBatch           = 100         //每次最多移动的消息数
+)
+
+//把到期的消息从延迟队列移到就绪队列
+var promoteScript = redis.NewScript(2, `
+local items = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, item in ipairs(items) do
+	redis.call('ZREM', KEYS[1], item)
+	redis.call('LPUSH', KEYS[2], item)
+end
+return #items
+`)
+
+//延迟队列（有序集合，分数为到期的毫秒时间戳）
+func delayedKey(queuename string) string {
+	return queuename + ":delayed"
+}
+
+//延迟消息的有效期从到期时间开始计算，避免延迟超过有效期的消息一到期就过期
+func delayDeadTime(model *QueueMsg, at int64) {
+	if now := nowMillis(); model.DeadTime > 0 && at > now {
+		model.DeadTime += at - now
+	}
+}
+
+//在指定时间入列，消息的有效期从at开始计算
+func (q *RedisQueue) EnQueueAt(model *QueueMsg, queuename string, at time.Time) error {
+	return q.enqueueWith(context.Background(), model, queuename, func(ctx context.Context, model *QueueMsg, queuename string) error {
+		return q.pushAt(ctx, model, queuename, at)
+	})
+}
+
+func (q *RedisQueue) pushAt(ctx context.Context, model *QueueMsg, queuename string, at time.Time) (err error) {
+	ctx, span := startProducerSpan(ctx, q, model, queuename)
+	defer func() { qqredis.EndSpan(span, err) }()
+
+	score := at.UnixNano() / int64(time.Millisecond)
+	delayDeadTime(model, score)
+
+	bt, err := encodeMsg(q.codecFor(queuename), model)
+	if err != nil {
+		return err
+	}
+	delayed := delayedKey(q.readyKey(queuename, model.Weight))
+	if model.UniqueKey != "" {
+		err = pushUnique(ctx, q.redisclient, model, queuename, delayed, bt, "ZADD", score)
+	} else {
+		_, err = q.redisclient.DoContext(ctx, "ZADD", delayed, score, bt)
+	}
+	if err == nil {
+		q.metrics.IncEnqueued(queuename)
+	}
+	return err
+}
+
+//延迟一段时间后入列
+func (q *RedisQueue) EnQueueIn(model *QueueMsg, queuename string, delay time.Duration) error {
+	return q.EnQueueAt(model, queuename, time.Now().Add(delay))
+}
+
+//把一个队列里到期的消息移到就绪队列，返回移动的数量
+func (q *RedisQueue) Promote(queuename string) (int, error) {
+	total := 0
+	for _, ready := range q.readyKeys(queuename) {
+		n, err := q.promote(ready)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (q *RedisQueue) promote(ready string) (int, error) {
+	total := 0
+	for {
+		n, err := redis.Int(q.redisclient.Eval(promoteScript, delayedKey(ready), ready, nowMillis(), promoteBatch))
+		total += n
+		if err != nil || n < promoteBatch {
+			return total, err
+		}
+	}
+}
+
+//定时移动到期的消息
+func (q *RedisQueue) runPromoter() {
+	for q.IsRunning() {
+		for _, name := range q.deQueueName {
+			if _, err := q.Promote(name); err != nil {
+				logger.LogWarn(fmt.Sprintf("RedisQueue promote error: %v, queue:%s", err, name))
+			}
+		}
+		if !q.sleep(q.promoteInterval) {
+			return
+		}
+	}
+}
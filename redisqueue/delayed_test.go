@@ -0,0 +1,68 @@
+package redisqueue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPromoteOrder(t *testing.T) {
+	_, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, "")
+
+	now := time.Now()
+	for _, c := range []struct {
+		guid string
+		at   time.Duration
+	}{{"late", 20 * time.Millisecond}, {"early", 10 * time.Millisecond}, {"future", time.Hour}} {
+		qm, _ := NewQueueMsg(map[string]interface{}{"n": c.guid}, 1, 0)
+		qm.UUID = c.guid
+		if err := q.EnQueueAt(qm, "dq", now.Add(c.at)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := q.Promote("dq"); n != 0 || err != nil {
+		t.Fatalf("promote before due = %d, %v, want 0", n, err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if n, err := q.Promote("dq"); n != 2 || err != nil {
+		t.Fatalf("promote = %d, %v, want 2", n, err)
+	}
+	//先到期的先出列
+	for _, want := range []string{"early", "late"} {
+		_, qm, _ := q.DeQueue("dq")
+		if qm == nil || qm.UUID != want {
+			t.Errorf("dequeued %+v, want %s", qm, want)
+		}
+	}
+	if n, _ := rc.Zcard(delayedKey("dq")); n != 1 {
+		t.Errorf("delayed = %d, want 1", n)
+	}
+}
+
+func TestDelayLongerThanTTL(t *testing.T) {
+	s, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, "")
+
+	qm, _ := NewQueueMsg(map[string]interface{}{"n": 1}, 1, 0, WithTTL(time.Hour))
+	if err := q.EnQueueIn(qm, "dq", 3*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	delayed, _ := s.ZMembers(delayedKey("dq"))
+	if len(delayed) != 1 {
+		t.Fatalf("delayed = %v", delayed)
+	}
+
+	//模拟到期
+	s.ZAdd(delayedKey("dq"), 0, delayed[0])
+	if n, _ := q.Promote("dq"); n != 1 {
+		t.Fatalf("promote = %d, want 1", n)
+	}
+	_, got, _ := q.DeQueue("dq")
+	if got == nil || got.Expired() {
+		t.Fatalf("dequeued %+v, want a live message", got)
+	}
+	if remain := got.DeadTime - nowMillis(); remain < int64(3*time.Hour/time.Millisecond) {
+		t.Errorf("remaining ttl = %dms, want at least delay + ttl", remain)
+	}
+}
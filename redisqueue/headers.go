@@ -0,0 +1,80 @@
+package redisqueue
+
+import "go.opentelemetry.io/otel/propagation"
+
+const HeaderTenant = "tenant" //租户
+
+//消息头，Headers为空时返回""
+func (qm *QueueMsg) Header(key string) string {
+	return qm.Headers[key]
+}
+
+//读取消息头，ok表示是否存在
+func (qm *QueueMsg) LookupHeader(key string) (value string, ok bool) {
+	value, ok = qm.Headers[key]
+	return
+}
+
+//设置消息头，需要在入列前设置
+func (qm *QueueMsg) SetHeader(key, value string) {
+	if qm.Headers == nil {
+		qm.Headers = make(map[string]string)
+	}
+	qm.Headers[key] = value
+}
+
+//删除消息头
+func (qm *QueueMsg) DelHeader(key string) {
+	delete(qm.Headers, key)
+}
+
+//消息头的副本
+func (qm *QueueMsg) CopyHeaders() map[string]string {
+	if qm.Headers == nil {
+		return nil
+	}
+	headers := make(map[string]string, len(qm.Headers))
+	for k, v := range qm.Headers {
+		headers[k] = v
+	}
+	return headers
+}
+
+// 用消息头读写链路上下文（otel的TextMapCarrier）
+type headerCarrier struct {
+	qm *QueueMsg
+}
+
+var _ propagation.TextMapCarrier = headerCarrier{}
+
+func (c headerCarrier) Get(key string) string {
+	return c.qm.Header(key)
+}
+
+func (c headerCarrier) Set(key, value string) {
+	c.qm.SetHeader(key, value)
+}
+
+func (c headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(c.qm.Headers))
+	for k := range c.qm.Headers {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+//设置消息头
+func WithHeader(key, value string) MsgOption {
+	return func(qm *QueueMsg) {
+		qm.SetHeader(key, value)
+	}
+}
+
+//设置多个消息头，已有的同名消息头会被覆盖
+func WithHeaders(headers map[string]string) MsgOption {
+	return func(qm *QueueMsg) {
+		for k, v := range headers {
+			qm.SetHeader(k, v)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package redisqueue
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHeaders(t *testing.T) {
+	qm, _ := NewQueueMsg(nil, 1, 0, WithHeader(HeaderTenant, "t1"), WithHeaders(map[string]string{"a": "1", "b": "2"}))
+	if qm.Header(HeaderTenant) != "t1" || qm.Header("a") != "1" {
+		t.Fatalf("headers = %v", qm.Headers)
+	}
+	if _, ok := qm.LookupHeader("missing"); ok {
+		t.Errorf("missing header found")
+	}
+
+	cp := qm.CopyHeaders()
+	qm.SetHeader("a", "changed")
+	qm.DelHeader("b")
+	if cp["a"] != "1" || cp["b"] != "2" {
+		t.Errorf("copy changed with original: %v", cp)
+	}
+	if _, ok := qm.LookupHeader("b"); ok {
+		t.Errorf("deleted header found")
+	}
+
+	empty := new(QueueMsg)
+	if empty.Header("a") != "" || empty.CopyHeaders() != nil {
+		t.Errorf("empty headers")
+	}
+	empty.DelHeader("a")
+}
+
+func TestHeadersRoundTrip(t *testing.T) {
+	qm, _ := NewQueueMsg(map[string]interface{}{"cmd": "x"}, 1, 1, WithHeader(HeaderTenant, "t1"))
+	for _, c := range []Codec{JSONCodec, MsgpackCodec, ProtobufCodec, GobCodec} {
+		data, err := encodeMsg(c, qm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := new(QueueMsg)
+		if err := decodeMsg(data, got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got.Headers, qm.Headers) {
+			t.Errorf("%s: headers = %v, want %v", c.ContentType(), got.Headers, qm.Headers)
+		}
+	}
+}
+
+func TestHeadersPreserved(t *testing.T) {
+	_, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, "hdr", WithVisibilityTimeout(time.Millisecond), WithRetryPolicy(RetryPolicy{}))
+	if _, err := EnQueueTask(q, map[string]interface{}{"n": 1}, 1, 3, "hdr", WithHeader(HeaderTenant, "t1")); err != nil {
+		t.Fatal(err)
+	}
+
+	//处理失败重试
+	_, qm, _ := q.DeQueue("hdr")
+	FailQueueTask(q, qm, "hdr", errors.New("failed"))
+	_, qm, _ = q.DeQueue("hdr")
+	if qm == nil || qm.Header(HeaderTenant) != "t1" || qm.Attempt != 1 {
+		t.Fatalf("nack: %+v", qm)
+	}
+
+	//超时回收
+	q.heartbeat()
+	time.Sleep(5 * time.Millisecond)
+	if err := q.Reap("hdr"); err != nil {
+		t.Fatal(err)
+	}
+	_, qm, _ = q.DeQueue("hdr")
+	if qm == nil || qm.Header(HeaderTenant) != "t1" || qm.Attempt != 2 {
+		t.Fatalf("reap: %+v", qm)
+	}
+
+	//死信重新入列
+	if err := q.DeadLetter(qm, "hdr", DeadReasonRetryExhausted, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.RequeueAllDead("hdr", 1); err != nil {
+		t.Fatal(err)
+	}
+	_, qm, _ = q.DeQueue("hdr")
+	if qm == nil || qm.Header(HeaderTenant) != "t1" {
+		t.Fatalf("requeue dead: %+v", qm)
+	}
+
+	//BackQueue
+	if err := q.BackQueue(qm, "other"); err != nil {
+		t.Fatal(err)
+	}
+	_, qm, _ = q.DeQueue("other")
+	if qm == nil || qm.Header(HeaderTenant) != "t1" {
+		t.Fatalf("back queue: %+v", qm)
+	}
+}
@@ -0,0 +1,384 @@
+package redisqueue
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	errBadRequest = errors.New("redisqueue: bad request")
+	errMethod     = errors.New("redisqueue: method not allowed")
+	errForbidden  = errors.New("redisqueue: X-Requested-With header or json content type required")
+)
+
+// 队列管理的http接口和页面，可以挂到已有的管理后台上：
+//
+//	mux.Handle("/queues/", http.StripPrefix("/queues", redisqueue.NewHTTPHandler(admin)))
+//
+// 接口：
+//
+//	GET    /                                        管理页面
+//	GET    /api/queues?prefix=                      队列列表和统计
+//	GET    /api/queues/{queue}                      队列统计
+//	GET    /api/queues/{queue}/messages             按出列顺序查看消息，参数offset、count
+//	GET    /api/queues/{queue}/messages/{id}        按uuid查找消息
+//	DELETE /api/queues/{queue}/messages/{id}        删除消息
+//	GET    /api/queues/{queue}/dead                 死信列表，参数offset、count
+//	DELETE /api/queues/{queue}/dead                 清空死信
+//	POST   /api/queues/{queue}/dead/retry           全部死信放回队列，参数retry
+//	POST   /api/queues/{queue}/dead/{id}/retry      一条死信放回队列，参数retry
+//	DELETE /api/queues/{queue}/dead/{id}            删除一条死信
+//	GET    /api/workers                             worker运行状态
+//
+// 队列名称和id需要url编码；POST、DELETE请求需要带X-Requested-With头或者Content-Type: application/json，
+// 否则返回403，避免其他站点的页面通过表单等跨站请求修改队列
+type HTTPHandler struct {
+	admin *Admin
+
+	mu      sync.RWMutex
+	workers map[string]*Worker
+}
+
+//新建队列管理的http接口
+func NewHTTPHandler(a *Admin) *HTTPHandler {
+	return &HTTPHandler{
+		admin:   a,
+		workers: make(map[string]*Worker),
+	}
+}
+
+//注册worker，运行状态会在/api/workers中展示
+func (h *HTTPHandler) AddWorker(name string, w *Worker) {
+	h.mu.Lock()
+	h.workers[name] = w
+	h.mu.Unlock()
+}
+
+func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	//按编码后的路径拆分，队列名称里可以有"/"
+	path := strings.Trim(r.URL.EscapedPath(), "/")
+	if path == "" {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		//页面按相对路径请求api/，挂载路径没有以"/"结尾时跳转到带"/"的地址
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			redirectSlash(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(adminPage))
+		return
+	}
+
+	parts := strings.Split(path, "/")
+	if parts[0] != "api" || len(parts) < 2 {
+		http.NotFound(w, r)
+		return
+	}
+	for i, p := range parts {
+		var err error
+		if parts[i], err = url.PathUnescape(p); err != nil {
+			writeJSON(w, nil, errBadRequest)
+			return
+		}
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && !csrfSafe(r) {
+		writeJSON(w, nil, errForbidden)
+		return
+	}
+
+	var v interface{}
+	var err error
+	switch {
+	case len(parts) == 2 && parts[1] == "workers":
+		v, err = h.workerStats(r)
+	case parts[1] == "queues":
+		v, err = h.serveQueues(r, parts[2:])
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, v, err)
+}
+
+//跳转到请求地址加上"/"，StripPrefix之后r.URL不是原始地址，用RequestURI
+func redirectSlash(w http.ResponseWriter, r *http.Request) {
+	u, err := url.ParseRequestURI(r.RequestURI)
+	if err != nil {
+		u = r.URL
+	}
+	target := u.EscapedPath() + "/"
+	if u.RawQuery != "" {
+		target += "?" + u.RawQuery
+	}
+	http.Redirect(w, r, target, http.StatusMovedPermanently)
+}
+
+func (h *HTTPHandler) serveQueues(r *http.Request, parts []string) (interface{}, error) {
+	a := h.admin
+	method := r.Method
+
+	if len(parts) == 0 {
+		if method != http.MethodGet {
+			return nil, errMethod
+		}
+		return a.QueueStats(r.URL.Query().Get("prefix"))
+	}
+
+	queuename := parts[0]
+	switch {
+	case len(parts) == 1 && method == http.MethodGet:
+		return a.Stats(queuename)
+
+	case len(parts) == 2 && parts[1] == "messages" && method == http.MethodGet:
+		offset, count, err := pageArgs(r)
+		if err != nil {
+			return nil, err
+		}
+		return a.Peek(queuename, offset, count)
+
+	case len(parts) == 3 && parts[1] == "messages" && method == http.MethodGet:
+		return a.Find(queuename, parts[2])
+
+	case len(parts) == 3 && parts[1] == "messages" && method == http.MethodDelete:
+		return nil, a.Delete(queuename, parts[2])
+
+	case len(parts) == 2 && parts[1] == "dead" && method == http.MethodGet:
+		offset, count, err := pageArgs(r)
+		if err != nil {
+			return nil, err
+		}
+		return a.q.DeadMsgs(queuename, offset, offset+count-1)
+
+	case len(parts) == 2 && parts[1] == "dead" && method == http.MethodDelete:
+		return nil, a.q.PurgeDead(queuename)
+
+	case len(parts) == 3 && parts[1] == "dead" && parts[2] == "retry" && method == http.MethodPost:
+		retry, err := intArg(r, "retry", 3)
+		if err != nil {
+			return nil, err
+		}
+		n, err := a.q.RequeueAllDead(queuename, retry)
+		return map[string]int{"requeued": n}, err
+
+	case len(parts) == 4 && parts[1] == "dead" && parts[3] == "retry" && method == http.MethodPost:
+		retry, err := intArg(r, "retry", 3)
+		if err != nil {
+			return nil, err
+		}
+		return nil, a.q.RequeueDead(queuename, parts[2], retry)
+
+	case len(parts) == 3 && parts[1] == "dead" && method == http.MethodDelete:
+		return nil, a.q.DeleteDead(queuename, parts[2])
+	}
+	return nil, errMethod
+}
+
+func (h *HTTPHandler) workerStats(r *http.Request) (interface{}, error) {
+	if r.Method != http.MethodGet {
+		return nil, errMethod
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	names := make([]string, 0, len(h.workers))
+	for name := range h.workers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	type workerStatus struct {
+		Name string `json:"name"`
+		WorkerStats
+	}
+	stats := make([]workerStatus, 0, len(names))
+	for _, name := range names {
+		stats = append(stats, workerStatus{Name: name, WorkerStats: h.workers[name].Stats()})
+	}
+	return stats, nil
+}
+
+//跨站的表单和简单请求不能带自定义的头，也不能用json的Content-Type
+func csrfSafe(r *http.Request) bool {
+	if r.Header.Get("X-Requested-With") != "" {
+		return true
+	}
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return ct == "application/json"
+}
+
+func pageArgs(r *http.Request) (offset, count int, err error) {
+	if offset, err = intArg(r, "offset", 0); err != nil {
+		return
+	}
+	if count, err = intArg(r, "count", 20); err != nil {
+		return
+	}
+	if offset < 0 || count <= 0 {
+		err = errBadRequest
+	}
+	return
+}
+
+func intArg(r *http.Request, name string, def int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, errBadRequest
+	}
+	return n, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}, err error) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch err {
+		case ErrMsgNotFound, ErrDeadMsgNotFound:
+			status = http.StatusNotFound
+		case errBadRequest:
+			status = http.StatusBadRequest
+		case errMethod:
+			status = http.StatusMethodNotAllowed
+		case errForbidden:
+			status = http.StatusForbidden
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	if v == nil {
+		v = map[string]bool{"ok": true}
+	}
+	json.NewEncoder(w).Encode(v)
+}
+
+const adminPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>redisqueue</title>
+<style>
+body { font-family: sans-serif; margin: 20px; color: #222; }
+table { border-collapse: collapse; margin-bottom: 20px; }
+th, td { border: 1px solid #ccc; padding: 4px 10px; text-align: left; font-size: 13px; }
+th { background: #f3f3f3; }
+pre { margin: 0; max-width: 600px; overflow: auto; }
+a, button { cursor: pointer; }
+</style>
+</head>
+<body>
+<h2>队列</h2>
+<table id="queues"><tr><th>队列</th><th>待处理</th><th>延迟</th><th>处理中</th><th>死信</th><th>消费者</th></tr></table>
+<h2>Worker</h2>
+<table id="workers"><tr><th>名称</th><th>运行</th><th>协程</th><th>处理中</th><th>成功</th><th>失败</th><th>队列</th></tr></table>
+<div id="detail"></div>
+<script>
+function api(method, path) {
+	var opts = {method: method, headers: {"X-Requested-With": "redisqueue"}};
+	return fetch("api/" + path, opts).then(function (r) { return r.json(); });
+}
+function queuePath(n) {
+	return "queues/" + encodeURIComponent(n);
+}
+function el(tag, text) {
+	var e = document.createElement(tag);
+	if (text !== undefined) { e.textContent = String(text); }
+	return e;
+}
+function clickable(tag, text, handler) {
+	var e = el(tag, text);
+	e.addEventListener("click", handler);
+	return e;
+}
+function newTable(headers) {
+	var t = el("table"), tr = t.insertRow();
+	headers.forEach(function (h) { tr.appendChild(el("th", h)); });
+	return t;
+}
+function fill(t, rows) {
+	while (t.rows.length > 1) { t.deleteRow(1); }
+	rows.forEach(function (cells) {
+		var tr = t.insertRow();
+		cells.forEach(function (c) {
+			var td = tr.insertCell();
+			if (c instanceof Node) { td.appendChild(c); } else { td.textContent = String(c); }
+		});
+	});
+}
+function showDetail(title, t) {
+	var d = document.getElementById("detail");
+	d.textContent = "";
+	d.appendChild(title);
+	d.appendChild(t);
+}
+function load() {
+	api("GET", "queues").then(function (qs) {
+		fill(document.getElementById("queues"), qs.map(function (q) {
+			return [clickable("a", q.name, function () { showQueue(q.name); }), q.ready, q.delayed, q.processing,
+				clickable("a", q.dead, function () { showDead(q.name); }), q.consumers];
+		}));
+	});
+	api("GET", "workers").then(function (ws) {
+		fill(document.getElementById("workers"), ws.map(function (w) {
+			return [w.name, w.running, w.concurrency, w.busy, w.processed, w.failed, (w.queues || []).join(", ")];
+		}));
+	});
+}
+function showQueue(n) {
+	api("GET", queuePath(n) + "/messages?count=50").then(function (ms) {
+		var t = newTable(["uuid", "权重", "重试", "消息", ""]);
+		fill(t, ms.map(function (m) {
+			var path = queuePath(n) + "/messages/" + encodeURIComponent(m.uuid);
+			return [m.uuid, m.weight, m.retry, el("pre", JSON.stringify(m.msg || m.body)),
+				clickable("button", "删除", function () { act("DELETE", path, n, false); })];
+		}));
+		showDetail(el("h2", n), t);
+	});
+}
+function showDead(n) {
+	api("GET", queuePath(n) + "/dead?count=50").then(function (ds) {
+		var title = el("h2", n + " 死信 ");
+		title.appendChild(clickable("button", "全部重试", function () { act("POST", queuePath(n) + "/dead/retry", n, true); }));
+		var t = newTable(["uuid", "原因", "错误", "时间", "消息", ""]);
+		fill(t, ds.map(function (d) {
+			var id = d.msg ? d.msg.uuid : "", ops = el("span");
+			if (id) {
+				var path = queuePath(n) + "/dead/" + encodeURIComponent(id);
+				ops.appendChild(clickable("button", "重试", function () { act("POST", path + "/retry", n, true); }));
+				ops.appendChild(clickable("button", "删除", function () { act("DELETE", path, n, true); }));
+			}
+			return [id, d.reason, d.last_error || "", new Date(d.dead_time).toLocaleString(),
+				el("pre", JSON.stringify(d.msg ? (d.msg.msg || d.msg.body) : null)), ops];
+		}));
+		showDetail(title, t);
+	});
+}
+function act(method, path, n, dead) {
+	api(method, path).then(function (r) {
+		if (r.error) { alert(r.error); }
+		load();
+		if (dead) { showDead(n); } else { showQueue(n); }
+	});
+}
+load();
+setInterval(load, 5000);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,190 @@
+package redisqueue
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestHTTP(t *testing.T, queuename string) (*RedisQueue, *httptest.Server) {
+	_, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, queuename)
+	h := NewHTTPHandler(NewAdmin(q))
+	h.AddWorker("w1", NewWorker(q, 2))
+	srv := httptest.NewServer(http.StripPrefix("/queues", h))
+	t.Cleanup(srv.Close)
+	return q, srv
+}
+
+func doHTTP(t *testing.T, srv *httptest.Server, method, path string, header bool, v interface{}) int {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+"/queues"+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header {
+		req.Header.Set("X-Requested-With", "test")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	bt, _ := io.ReadAll(resp.Body)
+	if v != nil {
+		if err := json.Unmarshal(bt, v); err != nil {
+			t.Fatalf("%s %s: %v, body:%s", method, path, err, bt)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestHTTPPage(t *testing.T) {
+	_, srv := newTestHTTP(t, "hq")
+
+	resp, err := http.Get(srv.URL + "/queues/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	bt, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(bt), "<html>") {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	if strings.Contains(string(bt), "onclick=") || strings.Contains(string(bt), "innerHTML") {
+		t.Error("admin page builds html from strings")
+	}
+}
+
+func TestHTTPPageRedirect(t *testing.T) {
+	_, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, "hq")
+	EnQueueTask(q, map[string]interface{}{"n": 1}, 1, 0, "hq")
+	h := http.StripPrefix("/admin/queues", NewHTTPHandler(NewAdmin(q)))
+	mux := http.NewServeMux()
+	mux.Handle("/admin/queues", h)
+	mux.Handle("/admin/queues/", h)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	//挂载路径不带"/"时跳转，页面里的相对地址api/才能指到接口
+	resp, err := http.Get(srv.URL + "/admin/queues?x=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/admin/queues/" || resp.Request.URL.RawQuery != "x=1" {
+		t.Fatalf("status = %d, url = %s", resp.StatusCode, resp.Request.URL)
+	}
+
+	api, _ := resp.Request.URL.Parse("api/queues/hq")
+	resp, err = http.Get(api.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var st QueueStats
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil || st.Ready != 1 {
+		t.Errorf("GET %s = %d, %+v, %v", api, resp.StatusCode, st, err)
+	}
+}
+
+func TestHTTPMessages(t *testing.T) {
+	//队列名称里有"/"和引号
+	name := "game/o'neil"
+	q, srv := newTestHTTP(t, name)
+	escaped := "game%2Fo%27neil"
+
+	id1, _ := EnQueueTask(q, map[string]interface{}{"n": 1}, 2, 1, name)
+	id2, _ := EnQueueTask(q, map[string]interface{}{"n": 2}, 2, 1, name)
+
+	var stats []*QueueStats
+	if code := doHTTP(t, srv, "GET", "/api/queues", false, &stats); code != http.StatusOK || len(stats) != 1 || stats[0].Name != name || stats[0].Ready != 2 {
+		t.Fatalf("queues: %d %+v", code, stats)
+	}
+	var st QueueStats
+	if code := doHTTP(t, srv, "GET", "/api/queues/"+escaped, false, &st); code != http.StatusOK || st.Ready != 2 {
+		t.Fatalf("stats: %d %+v", code, st)
+	}
+	var qms []*QueueMsg
+	if code := doHTTP(t, srv, "GET", "/api/queues/"+escaped+"/messages?count=1", false, &qms); code != http.StatusOK || len(qms) != 1 || qms[0].UUID != id1 {
+		t.Fatalf("peek: %d %+v", code, qms)
+	}
+	if code := doHTTP(t, srv, "GET", "/api/queues/"+escaped+"/messages?count=x", false, nil); code != http.StatusBadRequest {
+		t.Errorf("bad count: %d", code)
+	}
+
+	var fm FoundMsg
+	if code := doHTTP(t, srv, "GET", "/api/queues/"+escaped+"/messages/"+id2, false, &fm); code != http.StatusOK || fm.Msg.UUID != id2 {
+		t.Fatalf("find: %d %+v", code, fm)
+	}
+	if code := doHTTP(t, srv, "DELETE", "/api/queues/"+escaped+"/messages/"+id2, false, nil); code != http.StatusForbidden {
+		t.Errorf("delete without header: %d", code)
+	}
+	if code := doHTTP(t, srv, "DELETE", "/api/queues/"+escaped+"/messages/"+id2, true, nil); code != http.StatusOK {
+		t.Errorf("delete: %d", code)
+	}
+	if code := doHTTP(t, srv, "GET", "/api/queues/"+escaped+"/messages/"+id2, false, nil); code != http.StatusNotFound {
+		t.Errorf("find deleted: %d", code)
+	}
+	if code := doHTTP(t, srv, "PUT", "/api/queues/"+escaped, true, nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("put: %d", code)
+	}
+}
+
+func TestHTTPDead(t *testing.T) {
+	q, srv := newTestHTTP(t, "hq")
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		qm, _ := NewQueueMsg(map[string]interface{}{"n": i}, 2, 0)
+		if err := q.DeadLetter(qm, "hq", DeadReasonRetryExhausted, nil); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, qm.UUID)
+	}
+
+	var dms []*DeadMsg
+	if code := doHTTP(t, srv, "GET", "/api/queues/hq/dead", false, &dms); code != http.StatusOK || len(dms) != 3 {
+		t.Fatalf("dead: %d %d", code, len(dms))
+	}
+	if code := doHTTP(t, srv, "POST", "/api/queues/hq/dead/"+ids[0]+"/retry", false, nil); code != http.StatusForbidden {
+		t.Errorf("retry without header: %d", code)
+	}
+	if code := doHTTP(t, srv, "POST", "/api/queues/hq/dead/"+ids[0]+"/retry?retry=2", true, nil); code != http.StatusOK {
+		t.Errorf("retry: %d", code)
+	}
+	if code := doHTTP(t, srv, "DELETE", "/api/queues/hq/dead/"+ids[1], true, nil); code != http.StatusOK {
+		t.Errorf("delete dead: %d", code)
+	}
+	if code := doHTTP(t, srv, "DELETE", "/api/queues/hq/dead/"+ids[1], true, nil); code != http.StatusNotFound {
+		t.Errorf("delete missing dead: %d", code)
+	}
+	var requeued map[string]int
+	if code := doHTTP(t, srv, "POST", "/api/queues/hq/dead/retry", true, &requeued); code != http.StatusOK || requeued["requeued"] != 1 {
+		t.Errorf("retry all: %d %v", code, requeued)
+	}
+
+	var st QueueStats
+	if doHTTP(t, srv, "GET", "/api/queues/hq", false, &st); st.Ready != 2 || st.Dead != 0 {
+		t.Errorf("stats = %+v", st)
+	}
+}
+
+func TestHTTPWorkers(t *testing.T) {
+	_, srv := newTestHTTP(t, "hq")
+
+	var ws []struct {
+		Name        string `json:"name"`
+		Concurrency int    `json:"concurrency"`
+	}
+	if code := doHTTP(t, srv, "GET", "/api/workers", false, &ws); code != http.StatusOK || len(ws) != 1 || ws[0].Name != "w1" || ws[0].Concurrency != 2 {
+		t.Errorf("workers: %d %+v", code, ws)
+	}
+	if code := doHTTP(t, srv, "GET", "/api/nothing", false, nil); code != http.StatusNotFound {
+		t.Errorf("unknown route: %d", code)
+	}
+}
@@ -0,0 +1,92 @@
+package redisqueue
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"hallversion/common/qqredis"
+)
+
+const DefaultLedgerTTL = 24 * time.Hour
+
+// 已处理消息的台账，记录处理成功的消息uuid，用于跳过重复投递的消息
+type Ledger struct {
+	redisclient qqredis.RedisCache
+	ttl         time.Duration
+
+	checked uint64
+	hits    uint64
+	skipped uint64
+	marked  uint64
+	errors  uint64
+}
+
+// 台账的统计数据
+type LedgerStats struct {
+	Checked uint64 //查询次数
+	Hits    uint64 //命中次数（消息已经处理过）
+	Skipped uint64 //跳过处理函数的消息数
+	Marked  uint64 //记录为已处理的消息数
+	Errors  uint64 //读写台账失败的次数
+}
+
+//新建台账，ttl为记录的保留时间，应该大于消息可能被重复投递的时间
+func NewLedger(rc qqredis.RedisCache, ttl time.Duration) *Ledger {
+	if ttl <= 0 {
+		ttl = DefaultLedgerTTL
+	}
+	return &Ledger{redisclient: rc, ttl: ttl}
+}
+
+func ledgerKey(queuename, guid string) string {
+	return queuename + ":processed:" + guid
+}
+
+//消息是否已经处理过
+func (l *Ledger) Seen(ctx context.Context, queuename, guid string) (bool, error) {
+	atomic.AddUint64(&l.checked, 1)
+	n, err := redis.Int(l.redisclient.DoContext(ctx, "EXISTS", ledgerKey(queuename, guid)))
+	if err != nil {
+		atomic.AddUint64(&l.errors, 1)
+		return false, err
+	}
+	if n == 0 {
+		return false, nil
+	}
+	atomic.AddUint64(&l.hits, 1)
+	return true, nil
+}
+
+//记录消息已经处理
+func (l *Ledger) Mark(ctx context.Context, queuename, guid string) error {
+	_, err := l.redisclient.DoContext(ctx, "SET", ledgerKey(queuename, guid), nowMillis(), "PX", int64(l.ttl/time.Millisecond))
+	if err != nil {
+		atomic.AddUint64(&l.errors, 1)
+		return err
+	}
+	atomic.AddUint64(&l.marked, 1)
+	return nil
+}
+
+//删除消息的处理记录，之后重复投递的消息会再次处理
+func (l *Ledger) Forget(queuename, guid string) error {
+	_, err := l.redisclient.DoContext(context.Background(), "DEL", ledgerKey(queuename, guid))
+	return err
+}
+
+func (l *Ledger) skip() {
+	atomic.AddUint64(&l.skipped, 1)
+}
+
+//统计数据
+func (l *Ledger) Stats() LedgerStats {
+	return LedgerStats{
+		Checked: atomic.LoadUint64(&l.checked),
+		Hits:    atomic.LoadUint64(&l.hits),
+		Skipped: atomic.LoadUint64(&l.skipped),
+		Marked:  atomic.LoadUint64(&l.marked),
+		Errors:  atomic.LoadUint64(&l.errors),
+	}
+}
@@ -0,0 +1,95 @@
+package redisqueue
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLedger(t *testing.T) {
+	s, rc := newTestRedis(t)
+	l := NewLedger(rc, time.Minute)
+	ctx := context.Background()
+
+	if seen, err := l.Seen(ctx, "iq", "g1"); seen || err != nil {
+		t.Fatalf("Seen = %v, %v, want false", seen, err)
+	}
+	if err := l.Mark(ctx, "iq", "g1"); err != nil {
+		t.Fatal(err)
+	}
+	if seen, _ := l.Seen(ctx, "iq", "g1"); !seen {
+		t.Error("marked message not seen")
+	}
+	if ttl := s.TTL(ledgerKey("iq", "g1")); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("ledger ttl = %v", ttl)
+	}
+
+	if err := l.Forget("iq", "g1"); err != nil {
+		t.Fatal(err)
+	}
+	if seen, _ := l.Seen(ctx, "iq", "g1"); seen {
+		t.Error("forgotten message still seen")
+	}
+	if st := l.Stats(); st.Checked != 3 || st.Hits != 1 || st.Marked != 1 {
+		t.Errorf("stats = %+v", st)
+	}
+}
+
+func TestWorkerLedgerSkipsDuplicate(t *testing.T) {
+	_, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, "", WithRetryPolicy(RetryPolicy{}))
+	l := NewLedger(rc, time.Minute)
+
+	calls := 0
+	w := NewWorker(q, 1, WithLedger(l))
+	w.Handle("iq", func(ctx context.Context, qm *QueueMsg) error {
+		calls++
+		return nil
+	})
+
+	//同一条消息投递两次
+	qm, _ := NewQueueMsg(map[string]interface{}{"n": 1}, 1, 1)
+	q.EnQueue(qm, "iq")
+	q.EnQueue(qm, "iq")
+	for i := 0; i < 2; i++ {
+		qname, got, err := q.DeQueue("iq")
+		if err != nil || got == nil {
+			t.Fatalf("DeQueue: %+v, %v", got, err)
+		}
+		w.process(context.Background(), got, qname)
+	}
+
+	if calls != 1 {
+		t.Errorf("handler calls = %d, want 1", calls)
+	}
+	if n, ts := inProcessing(t, q, "iq"); n != 0 || ts != 0 {
+		t.Errorf("processing = %d, ts = %d, want both acked", n, ts)
+	}
+	if st := l.Stats(); st.Skipped != 1 || st.Marked != 1 {
+		t.Errorf("stats = %+v", st)
+	}
+}
+
+func TestWorkerLedgerFailureNotMarked(t *testing.T) {
+	_, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, "", WithRetryPolicy(RetryPolicy{}))
+	l := NewLedger(rc, time.Minute)
+
+	w := NewWorker(q, 1, WithLedger(l))
+	w.Handle("iq", func(ctx context.Context, qm *QueueMsg) error {
+		return errors.New("boom")
+	})
+
+	guid, _ := EnQueueTask(q, map[string]interface{}{"n": 1}, 1, 1, "iq")
+	qname, qm, _ := q.DeQueue("iq")
+	w.process(context.Background(), qm, qname)
+
+	//处理失败的消息不记录，重试时照常处理
+	if seen, _ := l.Seen(context.Background(), "iq", guid); seen {
+		t.Error("failed message marked as processed")
+	}
+	if _, qm, _ = q.DeQueue("iq"); qm == nil || qm.UUID != guid || qm.Attempt != 1 {
+		t.Errorf("retried %+v", qm)
+	}
+}
@@ -0,0 +1,90 @@
+package redisqueue
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/weikaishio/go-logger/logger"
+)
+
+const DefaultDepthInterval = 15 * time.Second //队列长度的采样间隔
+
+// 监控指标，实现需要并发安全，见prommetrics
+type Metrics interface {
+	IncEnqueued(queue string)                             //入列
+	IncDequeued(queue string)                             //出列
+	IncAcked(queue string)                                //处理完成
+	IncRetried(queue string)                              //重试
+	IncDeadLettered(queue, reason string)                 //进入死信队列
+	IncExpired(queue string)                              //过期
+	ObserveHandlerLatency(queue string, d time.Duration)  //处理函数耗时
+	ObserveEndToEndLatency(queue string, d time.Duration) //从创建到处理完成的耗时
+	SetQueueDepth(queue string, st *QueueStats)           //队列长度
+}
+
+// 不记录任何指标，默认使用
+type NopMetrics struct{}
+
+func (NopMetrics) IncEnqueued(queue string)                             {}
+func (NopMetrics) IncDequeued(queue string)                             {}
+func (NopMetrics) IncAcked(queue string)                                {}
+func (NopMetrics) IncRetried(queue string)                              {}
+func (NopMetrics) IncDeadLettered(queue, reason string)                 {}
+func (NopMetrics) IncExpired(queue string)                              {}
+func (NopMetrics) ObserveHandlerLatency(queue string, d time.Duration)  {}
+func (NopMetrics) ObserveEndToEndLatency(queue string, d time.Duration) {}
+func (NopMetrics) SetQueueDepth(queue string, st *QueueStats)           {}
+
+//监控指标，消费者Start后会按DefaultDepthInterval采样队列长度
+func WithMetrics(m Metrics) QueueOption {
+	return func(q *RedisQueue) {
+		q.metrics = m
+	}
+}
+
+//队列长度的采样间隔
+func WithDepthInterval(d time.Duration) QueueOption {
+	return func(q *RedisQueue) {
+		q.depthInterval = d
+	}
+}
+
+//监控指标
+func (q *RedisQueue) Metrics() Metrics {
+	return q.metrics
+}
+
+//Queue的监控指标，不是RedisQueue的不记录
+func metricsOf(q Queue) Metrics {
+	if p, ok := q.(interface{ Metrics() Metrics }); ok {
+		return p.Metrics()
+	}
+	return NopMetrics{}
+}
+
+//从创建到现在的耗时
+func sinceCreated(qm *QueueMsg) time.Duration {
+	return time.Duration(nowMillis()-qm.Createdtime) * time.Millisecond
+}
+
+//定时采样队列长度
+func (q *RedisQueue) runDepthSampler() {
+	if _, ok := q.metrics.(NopMetrics); ok {
+		return
+	}
+
+	admin := NewAdmin(q)
+	for q.IsRunning() {
+		for _, name := range q.deQueueName {
+			st, err := admin.Stats(name)
+			if err != nil {
+				logger.LogWarn(fmt.Sprintf("RedisQueue depth error: %v, queue:%s", err, name))
+				continue
+			}
+			q.metrics.SetQueueDepth(name, st)
+		}
+		if !q.sleep(q.depthInterval) {
+			return
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package redisqueue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/weikaishio/go-logger/logger"
+)
+
+var ErrMsgTooLarge = errors.New("redisqueue: message too large")
+
+// 消费者中间件，包装处理函数
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// 入列函数
+type EnqueueFunc func(ctx context.Context, qm *QueueMsg, queuename string) error
+
+// 生产者中间件，包装入列，可以修改消息（例如设置消息头）或者拒绝入列
+type EnqueueMiddleware func(next EnqueueFunc) EnqueueFunc
+
+//组合中间件，第一个在最外层
+func Chain(h HandlerFunc, mws ...Middleware) HandlerFunc {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+//组合生产者中间件，第一个在最外层
+func ChainEnqueue(f EnqueueFunc, mws ...EnqueueMiddleware) EnqueueFunc {
+	for i := len(mws) - 1; i >= 0; i-- {
+		f = mws[i](f)
+	}
+	return f
+}
+
+//生产者中间件，EnQueue、EnQueueAt都会经过
+func WithEnqueueMiddleware(mws ...EnqueueMiddleware) QueueOption {
+	return func(q *RedisQueue) {
+		q.enqueueMiddlewares = append(q.enqueueMiddlewares, mws...)
+	}
+}
+
+//经过生产者中间件后入列
+func (q *RedisQueue) enqueueWith(ctx context.Context, model *QueueMsg, queuename string, push EnqueueFunc) error {
+	if len(q.enqueueMiddlewares) == 0 {
+		return push(ctx, model, queuename)
+	}
+	return ChainEnqueue(push, q.enqueueMiddlewares...)(ctx, model, queuename)
+}
+
+//panic转成错误，消息按处理失败重试或者进入死信队列
+//Worker已经会恢复panic，单独使用处理函数时可以用这个
+func Recover() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, qm *QueueMsg) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					logger.LogError(fmt.Sprintf("HandlerFunc panic, err:%v", r))
+					logger.LogError(string(debug.Stack()))
+					err = fmt.Errorf("panic: %v", r)
+				}
+			}()
+			return next(ctx, qm)
+		}
+	}
+}
+
+//记录每条消息的处理结果和耗时
+func Logging() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, qm *QueueMsg) error {
+			start := time.Now()
+			err := next(ctx, qm)
+			if err != nil {
+				logger.LogWarn(fmt.Sprintf("消息处理失败 guid:%s,attempt:%d,cost:%v,err:%v", qm.UUID, qm.Attempt, time.Since(start), err))
+			} else {
+				logger.LogInfo(fmt.Sprintf("消息处理完成 guid:%s,attempt:%d,cost:%v", qm.UUID, qm.Attempt, time.Since(start)))
+			}
+			return err
+		}
+	}
+}
+
+//处理前校验消息，校验失败的不调用处理函数，按处理失败处理
+//可以用来检查消息体格式或者消息头里的权限信息
+func Validate(check func(qm *QueueMsg) error) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, qm *QueueMsg) error {
+			if err := check(qm); err != nil {
+				return err
+			}
+			return next(ctx, qm)
+		}
+	}
+}
+
+//入列时设置消息头，消息里已有的不会覆盖
+func StampHeaders(headers map[string]string) EnqueueMiddleware {
+	return func(next EnqueueFunc) EnqueueFunc {
+		return func(ctx context.Context, qm *QueueMsg, queuename string) error {
+			for k, v := range headers {
+				if _, ok := qm.LookupHeader(k); !ok {
+					qm.SetHeader(k, v)
+				}
+			}
+			return next(ctx, qm, queuename)
+		}
+	}
+}
+
+//限制消息体（Msg和Body按json计算）的大小，超过的返回ErrMsgTooLarge
+func MaxPayloadSize(size int) EnqueueMiddleware {
+	return func(next EnqueueFunc) EnqueueFunc {
+		return func(ctx context.Context, qm *QueueMsg, queuename string) error {
+			n := len(qm.Body)
+			if qm.Msg != nil {
+				bt, err := json.Marshal(qm.Msg)
+				if err != nil {
+					return err
+				}
+				n += len(bt)
+			}
+			if n > size {
+				return ErrMsgTooLarge
+			}
+			return next(ctx, qm, queuename)
+		}
+	}
+}
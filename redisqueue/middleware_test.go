@@ -0,0 +1,78 @@
+package redisqueue
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestChain(t *testing.T) {
+	var calls []string
+	mw := func(name string) Middleware {
+		return func(next HandlerFunc) HandlerFunc {
+			return func(ctx context.Context, qm *QueueMsg) error {
+				calls = append(calls, name+">")
+				err := next(ctx, qm)
+				calls = append(calls, "<"+name)
+				return err
+			}
+		}
+	}
+	h := Chain(func(ctx context.Context, qm *QueueMsg) error {
+		calls = append(calls, "h")
+		return nil
+	}, mw("a"), mw("b"))
+
+	if err := h(context.Background(), new(QueueMsg)); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a>", "b>", "h", "<b", "<a"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+}
+
+func TestBuiltinMiddleware(t *testing.T) {
+	errInvalid := errors.New("invalid")
+	called := false
+	h := Chain(func(ctx context.Context, qm *QueueMsg) error {
+		called = true
+		panic("boom")
+	}, Logging(), Recover(), Validate(func(qm *QueueMsg) error {
+		if qm.Header("token") == "" {
+			return errInvalid
+		}
+		return nil
+	}))
+
+	if err := h(context.Background(), new(QueueMsg)); err != errInvalid || called {
+		t.Errorf("validate: err = %v, called = %v", err, called)
+	}
+	qm, _ := NewQueueMsg(nil, 1, 0, WithHeader("token", "t"))
+	if err := h(context.Background(), qm); err == nil || !strings.Contains(err.Error(), "boom") || !called {
+		t.Errorf("recover: err = %v, called = %v", err, called)
+	}
+}
+
+func TestEnqueueMiddleware(t *testing.T) {
+	var got *QueueMsg
+	push := ChainEnqueue(func(ctx context.Context, qm *QueueMsg, queuename string) error {
+		got = qm
+		return nil
+	}, StampHeaders(map[string]string{HeaderTenant: "default", "source": "api"}), MaxPayloadSize(32))
+
+	qm, _ := NewQueueMsg(map[string]interface{}{"k": "v"}, 1, 0, WithHeader(HeaderTenant, "t1"))
+	if err := push(context.Background(), qm, "q"); err != nil {
+		t.Fatal(err)
+	}
+	if got != qm || qm.Header(HeaderTenant) != "t1" || qm.Header("source") != "api" {
+		t.Errorf("headers = %v", qm.Headers)
+	}
+
+	got = nil
+	big, _ := NewQueueMsg(map[string]interface{}{"k": strings.Repeat("x", 32)}, 1, 0)
+	if err := push(context.Background(), big, "q"); err != ErrMsgTooLarge || got != nil {
+		t.Errorf("err = %v, pushed = %v", err, got != nil)
+	}
+}
@@ -0,0 +1,16 @@
+package redisqueue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"hallversion/common/qqredis"
+)
+
+//测试用的redis，测试结束后自动关闭
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, qqredis.RedisCache) {
+	t.Helper()
+	s := miniredis.RunT(t)
+	return s, qqredis.NewRedisCache(s.Addr(), "", time.Hour, 0)
+}
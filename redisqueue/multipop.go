@@ -0,0 +1,129 @@
+package redisqueue
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/weikaishio/go-logger/logger"
+)
+
+// 拉取消息的方式
+type PopMode int
+
+const (
+	PopPerQueue   PopMode = iota //每个队列一个协程各自BRPOPLPUSH（默认）
+	PopStrict                    //一个BRPOP监听全部队列，按队列顺序优先
+	PopRoundRobin                //一个BRPOP监听全部队列，每次轮换第一个队列
+	PopWeighted                  //一个BRPOP监听全部队列，按队列权重随机排序
+)
+
+//记录BRPOP取出的消息到处理中列表
+var trackScript = redis.NewScript(2, `
+redis.call('LPUSH', KEYS[1], ARGV[1])
+redis.call('ZADD', KEYS[2], ARGV[2], ARGV[1])
+return 1
+`)
+
+//使用一个BRPOP监听全部队列，只占用一个连接
+//注意：BRPOP和放入处理中列表不是原子的，这期间进程崩溃会丢失这条消息
+func WithPopMode(mode PopMode) QueueOption {
+	return func(q *RedisQueue) {
+		q.popMode = mode
+	}
+}
+
+//PopWeighted模式下各个队列的权重，没有设置的为1
+func WithQueueWeights(weights map[string]int) QueueOption {
+	return func(q *RedisQueue) {
+		q.queueWeights = weights
+	}
+}
+
+//本次BRPOP的队列顺序
+func (q *RedisQueue) popOrder() []string {
+	n := len(q.deQueueName)
+	order := make([]string, 0, n)
+
+	switch q.popMode {
+	case PopRoundRobin:
+		start := int(atomic.AddUint64(&q.popCount, 1) % uint64(n))
+		for i := 0; i < n; i++ {
+			order = append(order, q.deQueueName[(start+i)%n])
+		}
+	case PopWeighted:
+		names := append([]string(nil), q.deQueueName...)
+		weights := make([]int, n)
+		total := 0
+		for i, name := range names {
+			weights[i] = 1
+			if w, ok := q.queueWeights[name]; ok && w > 0 {
+				weights[i] = w
+			}
+			total += weights[i]
+		}
+		for len(names) > 0 {
+			r := rand.Intn(total)
+			i := 0
+			for ; r >= weights[i]; i++ {
+				r -= weights[i]
+			}
+			order = append(order, names[i])
+			total -= weights[i]
+			names = append(names[:i], names[i+1:]...)
+			weights = append(weights[:i], weights[i+1:]...)
+		}
+	default:
+		order = append(order, q.deQueueName...)
+	}
+	return order
+}
+
+//一个BRPOP从全部队列出列
+func (q *RedisQueue) dequeueMulti() (string, *QueueMsg, error) {
+	if !q.IsRunning() {
+		return "", nil, nil
+	}
+
+	keys := make([]string, 0, len(q.deQueueName))
+	queues := make(map[string]string)
+	for _, name := range q.popOrder() {
+		for _, key := range q.readyKeys(name) {
+			keys = append(keys, key)
+			queues[key] = name
+		}
+	}
+
+	args := make([]interface{}, 0, len(keys)+1)
+	for _, key := range keys {
+		args = append(args, key)
+	}
+	args = append(args, PullQueueBlockTime)
+
+	reply, err := redis.ByteSlices(q.redisclient.DoContext(context.Background(), "BRPOP", args...))
+	if err != nil {
+		if err != redis.ErrNil {
+			logger.LogWarn(fmt.Sprintf("RedisQueue error: %v", err))
+			q.sleep(PullQueueErrTime * time.Second)
+		}
+		return "", nil, err
+	}
+	if len(reply) != 2 || reply[1] == nil {
+		return "", nil, nil
+	}
+	key, item := string(reply[0]), reply[1]
+
+	queuename := queues[key]
+	pkey := processingKey(queuename, q.consumerID)
+	if _, err := q.redisclient.EvalContext(context.Background(), trackScript, pkey, processingTsKey(pkey), item, nowMillis()); err != nil {
+		//没能放到处理中列表，放回原队列
+		logger.LogWarn(fmt.Sprintf("RedisQueue track error: %v, queue:%s", err, queuename))
+		q.redisclient.Rpush(key, item)
+		return "", nil, err
+	}
+
+	return q.deliver(queuename, pkey, item)
+}
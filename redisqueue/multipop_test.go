@@ -0,0 +1,98 @@
+package redisqueue
+
+import (
+	"testing"
+)
+
+func TestPopOrder(t *testing.T) {
+	q := &RedisQueue{deQueueName: []string{"a", "b", "c"}, popMode: PopStrict}
+	for i := 0; i < 3; i++ {
+		if order := q.popOrder(); order[0] != "a" || order[1] != "b" || order[2] != "c" {
+			t.Fatalf("strict order = %v", order)
+		}
+	}
+
+	//轮换时每个队列排在第一位的次数相同
+	q.popMode = PopRoundRobin
+	first := make(map[string]int)
+	for i := 0; i < 30; i++ {
+		order := q.popOrder()
+		if len(order) != 3 {
+			t.Fatalf("round robin order = %v", order)
+		}
+		first[order[0]]++
+	}
+	for _, name := range q.deQueueName {
+		if first[name] != 10 {
+			t.Errorf("round robin first = %v, want 10 each", first)
+		}
+	}
+}
+
+func TestPopOrderWeighted(t *testing.T) {
+	q := &RedisQueue{deQueueName: []string{"a", "b"}, popMode: PopWeighted, queueWeights: map[string]int{"a": 3}}
+
+	const runs = 4000
+	first := 0
+	for i := 0; i < runs; i++ {
+		order := q.popOrder()
+		if len(order) != 2 || order[0] == order[1] {
+			t.Fatalf("weighted order = %v", order)
+		}
+		if order[0] == "a" {
+			first++
+		}
+	}
+	//a的权重是3，b没有设置为1，a排在第一位的概率是3/4
+	if ratio := float64(first) / runs; ratio < 0.7 || ratio > 0.8 {
+		t.Errorf("a first ratio = %.2f, want about 0.75", ratio)
+	}
+}
+
+func TestDequeueMulti(t *testing.T) {
+	_, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, "a,b", WithPopMode(PopRoundRobin))
+
+	for i := 0; i < 2; i++ {
+		EnQueueTask(q, map[string]interface{}{"n": i}, 1, 0, "a")
+		EnQueueTask(q, map[string]interface{}{"n": i}, 1, 0, "b")
+	}
+
+	//两个队列都有消息时轮流出列
+	var got []string
+	for i := 0; i < 4; i++ {
+		qname, qm, err := q.dequeueMulti()
+		if err != nil || qm == nil {
+			t.Fatalf("dequeueMulti %d: %+v, %v", i, qm, err)
+		}
+		if n, ts := inProcessing(t, q, qname); n != 1 || ts != 1 {
+			t.Fatalf("processing = %d, ts = %d, want 1", n, ts)
+		}
+		if err := q.Ack(qm); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, qname)
+	}
+	for i := 1; i < len(got); i++ {
+		if got[i] == got[i-1] {
+			t.Fatalf("queues = %v, want alternating", got)
+		}
+	}
+}
+
+func TestDequeueMultiStrict(t *testing.T) {
+	_, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, "a,b", WithPopMode(PopStrict))
+
+	EnQueueTask(q, map[string]interface{}{"n": 1}, 1, 0, "b")
+	EnQueueTask(q, map[string]interface{}{"n": 2}, 1, 0, "a")
+	EnQueueTask(q, map[string]interface{}{"n": 3}, 1, 0, "a")
+
+	//按队列顺序优先
+	for _, want := range []string{"a", "a", "b"} {
+		qname, qm, err := q.dequeueMulti()
+		if err != nil || qm == nil || qname != want {
+			t.Fatalf("dequeueMulti = %q, %+v, %v, want %s", qname, qm, err, want)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package redisqueue
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const PriorityPollInterval = 100 * time.Millisecond //优先级模式下队列为空时的轮询间隔
+
+//按顺序从各个优先级队列取出一条消息放到处理中列表，KEYS[1]为处理中列表
+var priorityPopScript = redis.NewScript(-1, `
+for i = 2, #KEYS do
+	local item = redis.call('RPOPLPUSH', KEYS[i], KEYS[1])
+	if item then
+		return item
+	end
+end
+return false
+`)
+
+//消息的优先级，由Weight决定，范围为 0 ~ priorityLevels-1
+func (q *RedisQueue) priority(weight int) int {
+	if q.priorityLevels <= 1 || weight <= 0 {
+		return 0
+	}
+	if weight >= q.priorityLevels {
+		return q.priorityLevels - 1
+	}
+	return weight
+}
+
+//消息所在的就绪队列，优先级为0的就是队列本身，其他为 队列名称:p优先级
+func (q *RedisQueue) readyKey(queuename string, weight int) string {
+	level := q.priority(weight)
+	if level == 0 {
+		return queuename
+	}
+	return queuename + ":p" + strconv.Itoa(level)
+}
+
+//队列的全部就绪队列，优先级高的在前
+func (q *RedisQueue) readyKeys(queuename string) []string {
+	if q.priorityLevels <= 1 {
+		return []string{queuename}
+	}
+	keys := make([]string, 0, q.priorityLevels)
+	for level := q.priorityLevels - 1; level >= 0; level-- {
+		keys = append(keys, q.readyKey(queuename, level))
+	}
+	return keys
+}
+
+//按优先级出列，没有消息时轮询等待，最多等待block
+func (q *RedisQueue) popPriority(ctx context.Context, queuename, pkey string, block time.Duration) ([]byte, error) {
+	keys := q.readyKeys(queuename)
+	args := make([]interface{}, 0, len(keys)+2)
+	args = append(args, len(keys)+1, pkey)
+	for _, key := range keys {
+		args = append(args, key)
+	}
+
+	deadline := time.Now().Add(block)
+	for {
+		raw, err := q.redisclient.EvalContext(ctx, priorityPopScript, args...)
+		if err != nil {
+			return nil, err
+		}
+		if raw != nil {
+			return redis.Bytes(raw, nil)
+		}
+		if time.Now().After(deadline) || !q.sleepContext(ctx, PriorityPollInterval) {
+			return nil, nil
+		}
+	}
+}
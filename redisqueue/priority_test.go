@@ -0,0 +1,65 @@
+package redisqueue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPriorityKeys(t *testing.T) {
+	q := &RedisQueue{priorityLevels: 3}
+	for weight, want := range map[int]string{-1: "pq", 0: "pq", 1: "pq:p1", 2: "pq:p2", 9: "pq:p2"} {
+		if got := q.readyKey("pq", weight); got != want {
+			t.Errorf("readyKey(%d) = %q, want %q", weight, got, want)
+		}
+	}
+	keys := q.readyKeys("pq")
+	if len(keys) != 3 || keys[0] != "pq:p2" || keys[2] != "pq" {
+		t.Errorf("readyKeys = %v", keys)
+	}
+}
+
+func TestPriorityOrder(t *testing.T) {
+	_, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, "", WithPriorityLevels(3))
+
+	for _, weight := range []int{0, 2, 1, 2, 0} {
+		if _, err := EnQueueTask(q, map[string]interface{}{"w": weight}, weight, 0, "pq"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//优先级高的先出列，同一优先级先进先出
+	var got []int
+	for i := 0; i < 5; i++ {
+		_, qm, err := q.DeQueue("pq")
+		if err != nil || qm == nil {
+			t.Fatalf("DeQueue %d: %+v, %v", i, qm, err)
+		}
+		got = append(got, qm.Weight)
+		q.Ack(qm)
+	}
+	want := []int{2, 2, 1, 0, 0}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("order = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestPriorityPromote(t *testing.T) {
+	_, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, "", WithPriorityLevels(2))
+
+	low, _ := NewQueueMsg(map[string]interface{}{"n": 1}, 0, 0)
+	high, _ := NewQueueMsg(map[string]interface{}{"n": 2}, 1, 0)
+	q.EnQueueAt(low, "pq", time.Now())
+	q.EnQueueAt(high, "pq", time.Now())
+
+	if n, err := q.Promote("pq"); n != 2 || err != nil {
+		t.Fatalf("promote = %d, %v, want 2", n, err)
+	}
+	_, qm, _ := q.DeQueue("pq")
+	if qm == nil || qm.UUID != high.UUID {
+		t.Errorf("dequeued %+v, want the high priority message", qm)
+	}
+}
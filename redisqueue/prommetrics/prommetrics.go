@@ -0,0 +1,111 @@
+// prommetrics 把redisqueue的监控指标导出到Prometheus
+//
+//	m := prommetrics.New("game")
+//	prometheus.MustRegister(m)
+//	q := redisqueue.NewRedisQueue(rc, names, redisqueue.WithMetrics(m))
+package prommetrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"hallversion/common/redisqueue"
+)
+
+// 同时实现了redisqueue.Metrics和prometheus.Collector
+type Metrics struct {
+	enqueued       *prometheus.CounterVec
+	dequeued       *prometheus.CounterVec
+	acked          *prometheus.CounterVec
+	retried        *prometheus.CounterVec
+	deadLettered   *prometheus.CounterVec
+	expired        *prometheus.CounterVec
+	handlerLatency *prometheus.HistogramVec
+	endToEnd       *prometheus.HistogramVec
+	depth          *prometheus.GaugeVec
+}
+
+var _ redisqueue.Metrics = (*Metrics)(nil)
+
+//新建指标，namespace为指标名称的前缀，可以为空
+func New(namespace string) *Metrics {
+	counter := func(name, help string, labels ...string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "redisqueue",
+			Name:      name,
+			Help:      help,
+		}, append([]string{"queue"}, labels...))
+	}
+	histogram := func(name, help string, buckets []float64) *prometheus.HistogramVec {
+		return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "redisqueue",
+			Name:      name,
+			Help:      help,
+			Buckets:   buckets,
+		}, []string{"queue"})
+	}
+
+	return &Metrics{
+		enqueued:       counter("enqueued_total", "Messages enqueued."),
+		dequeued:       counter("dequeued_total", "Messages dequeued."),
+		acked:          counter("acked_total", "Messages acknowledged."),
+		retried:        counter("retried_total", "Messages put back for retry."),
+		deadLettered:   counter("dead_lettered_total", "Messages moved to the dead-letter queue.", "reason"),
+		expired:        counter("expired_total", "Messages expired before being handled."),
+		handlerLatency: histogram("handler_duration_seconds", "Handler execution time.", prometheus.DefBuckets),
+		endToEnd: histogram("end_to_end_duration_seconds", "Time from message creation to acknowledgement.",
+			prometheus.ExponentialBuckets(0.01, 4, 10)),
+		depth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "redisqueue",
+			Name:      "depth",
+			Help:      "Messages in the queue by state.",
+		}, []string{"queue", "state"}),
+	}
+}
+
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.enqueued, m.dequeued, m.acked, m.retried, m.deadLettered, m.expired,
+		m.handlerLatency, m.endToEnd, m.depth,
+	}
+}
+
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+}
+
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+}
+
+func (m *Metrics) IncEnqueued(queue string) { m.enqueued.WithLabelValues(queue).Inc() }
+func (m *Metrics) IncDequeued(queue string) { m.dequeued.WithLabelValues(queue).Inc() }
+func (m *Metrics) IncAcked(queue string)    { m.acked.WithLabelValues(queue).Inc() }
+func (m *Metrics) IncRetried(queue string)  { m.retried.WithLabelValues(queue).Inc() }
+func (m *Metrics) IncExpired(queue string)  { m.expired.WithLabelValues(queue).Inc() }
+
+func (m *Metrics) IncDeadLettered(queue, reason string) {
+	m.deadLettered.WithLabelValues(queue, reason).Inc()
+}
+
+func (m *Metrics) ObserveHandlerLatency(queue string, d time.Duration) {
+	m.handlerLatency.WithLabelValues(queue).Observe(d.Seconds())
+}
+
+func (m *Metrics) ObserveEndToEndLatency(queue string, d time.Duration) {
+	m.endToEnd.WithLabelValues(queue).Observe(d.Seconds())
+}
+
+func (m *Metrics) SetQueueDepth(queue string, st *redisqueue.QueueStats) {
+	m.depth.WithLabelValues(queue, redisqueue.MsgStateReady).Set(float64(st.Ready))
+	m.depth.WithLabelValues(queue, redisqueue.MsgStateDelayed).Set(float64(st.Delayed))
+	m.depth.WithLabelValues(queue, redisqueue.MsgStateProcessing).Set(float64(st.Processing))
+	m.depth.WithLabelValues(queue, redisqueue.MsgStateDead).Set(float64(st.Dead))
+}
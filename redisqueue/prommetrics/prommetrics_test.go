@@ -0,0 +1,75 @@
+package prommetrics
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"hallversion/common/qqredis"
+	"hallversion/common/redisqueue"
+)
+
+func TestMetrics(t *testing.T) {
+	s := miniredis.RunT(t)
+	rc := qqredis.NewRedisCache(s.Addr(), "", time.Hour, 0)
+
+	m := New("test")
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(m)
+
+	q := redisqueue.NewRedisQueue(rc, "pq", redisqueue.WithMetrics(m), redisqueue.WithDepthInterval(50*time.Millisecond), redisqueue.WithRetryPolicy(redisqueue.RetryPolicy{}))
+	q.Start()
+	w := redisqueue.NewWorker(q, 1)
+	w.Handle("pq", func(ctx context.Context, qm *redisqueue.QueueMsg) error {
+		if qm.Msg["fail"] == true {
+			return errors.New("failed")
+		}
+		return nil
+	})
+
+	redisqueue.EnQueueTask(q, map[string]interface{}{"n": 1}, 1, 1, "pq")
+	redisqueue.EnQueueTask(q, map[string]interface{}{"fail": true}, 1, 1, "pq")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	w.Run(ctx)
+
+	//不是由队列投递的消息放回队列也计入重试
+	qm, _ := redisqueue.NewQueueMsg(map[string]interface{}{"n": 2}, 1, 1)
+	redisqueue.FailQueueTask(q, qm, "other", errors.New("failed"))
+
+	cases := []struct {
+		name string
+		c    prometheus.Collector
+		want float64
+	}{
+		{"enqueued", m.enqueued.WithLabelValues("pq"), 2},
+		{"dequeued", m.dequeued.WithLabelValues("pq"), 3},
+		{"acked", m.acked.WithLabelValues("pq"), 1},
+		{"retried", m.retried.WithLabelValues("pq"), 1},
+		{"retried fallback", m.retried.WithLabelValues("other"), 1},
+		{"dead_lettered", m.deadLettered.WithLabelValues("pq", redisqueue.DeadReasonRetryExhausted), 1},
+		{"depth", m.depth.WithLabelValues("pq", redisqueue.MsgStateDead), 1},
+	}
+	for _, c := range cases {
+		if got := testutil.ToFloat64(c.c); got != c.want {
+			t.Errorf("%s = %v, want %v", c.name, got, c.want)
+		}
+	}
+
+	if n := testutil.CollectAndCount(m, "test_redisqueue_handler_duration_seconds"); n != 1 {
+		t.Errorf("handler latency series = %d, want 1", n)
+	}
+	want := `
+# HELP test_redisqueue_acked_total Messages acknowledged.
+# TYPE test_redisqueue_acked_total counter
+test_redisqueue_acked_total{queue="pq"} 1
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want), "test_redisqueue_acked_total"); err != nil {
+		t.Error(err)
+	}
+}
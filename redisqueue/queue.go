@@ -1,27 +1,31 @@
 package redisqueue
 
 import (
+	"context"
 	"encoding/gob"
-	"errors"
+	"encoding/json"
 	"fmt"
 	"runtime/debug"
 	"time"
 
 	"github.com/satori/go.uuid"
 	"github.com/weikaishio/go-logger/logger"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func init() {
 	Register(&QueueMsg{})
+	Register(map[string]interface{}{})
+	Register([]interface{}{})
 }
 
-// 注册对象用于序列化和反序列化
+// 注册对象用于序列化和反序列化（GobCodec编码Msg里的自定义类型时需要）
 func Register(obj interface{}) {
 	gob.Register(obj)
 }
 
 const (
-	MsgTimeOut = 6000 //消息超时时间
+	MsgTimeOut = 6000 //消息超时时间（秒），见DefaultMsgTTL
 	BkWeight   = 0    //消息处理失败是否重新加入队列，等级
 )
 
@@ -30,37 +34,76 @@ var RQueueClient Queue
 
 // 队列任务模型
 type QueueMsg struct {
-	UUID        string                 `json:"uuid"`        //uuid
-	Msg         map[string]interface{} `json:"msg"`         //消息体
-	Createdtime int64                  `json:"create_time"` //创建时间（毫秒）
-	DeadTime    int64                  `json:"dead_time"`   //过期时间（毫秒） 当过期时间小于0时 为永不过期
-	Weight      int                    `json:"weight"`      //消息的权重（主要用于处理消息处理失败后，该消息是否返回消息队列）
-	Retry       int                    `json:"retry"`       //消息的重试次数
+	UUID        string                 `json:"uuid"`                   //uuid
+	Msg         map[string]interface{} `json:"msg"`                    //消息体
+	Body        json.RawMessage        `json:"body,omitempty"`         //带类型的消息体（json），见TypedQueue
+	Createdtime int64                  `json:"create_time"`            //创建时间（毫秒）
+	DeadTime    int64                  `json:"dead_time"`              //过期时间（毫秒） 当过期时间小于0时 为永不过期
+	Weight      int                    `json:"weight"`                 //消息的权重（主要用于处理消息处理失败后，该消息是否返回消息队列）
+	Retry       int                    `json:"retry"`                  //消息的重试次数
+	Attempt     int                    `json:"attempt"`                //消息已经重试的次数
+	UniqueKey   string                 `json:"unique_key,omitempty"`   //唯一键，见WithUniqueKey
+	UniqueTTL   int64                  `json:"unique_ttl,omitempty"`   //唯一键的有效期（毫秒）
+	ExecTimeout int64                  `json:"exec_timeout,omitempty"` //处理超时时间（毫秒），0时使用worker对队列的设置
+	Headers     map[string]string      `json:"headers,omitempty"`      //消息头，入列、重试、回收和死信重新入列时都会保留，见headers.go
+
+	raw        []byte //出列时的原始数据，用于从处理中列表删除
+	queue      string //来源队列
+	processing string //所在的处理中列表
+	coalesce   bool   //重复入列时合并到已有的消息
+	streamID   string //StreamQueue出列的消息ID
+
+	spanContext trace.SpanContext //consumer span，Ack/Nack等操作的redis命令挂在下面
 }
 
 // 新建队列任务,会分配guid
-func NewQueueMsg(msg map[string]interface{}, weight, retry int) (*QueueMsg, error) {
+func NewQueueMsg(msg map[string]interface{}, weight, retry int, opts ...MsgOption) (*QueueMsg, error) {
 	uuid,_ := uuid.NewV4()
 
 	guid := uuid.String()
 
-	return &QueueMsg{
+	now := nowMillis()
+	qm := &QueueMsg{
 		UUID:        guid,
 		Msg:         msg,
-		Createdtime: time.Now().Unix(),
-		DeadTime:    time.Now().Unix() + MsgTimeOut,
+		Createdtime: now,
+		DeadTime:    now + int64(DefaultMsgTTL/time.Millisecond),
 		Weight:      weight,
 		Retry:       retry,
-	}, nil
+	}
+
+	for _, opt := range opts {
+		opt(qm)
+	}
+
+	return qm, nil
+}
+
+// 消息的配置项
+type MsgOption func(*QueueMsg)
+
+//处理超时时间，超时后处理函数的ctx会被取消，消息按处理失败重试或者进入死信队列，需要通过Worker处理
+func WithExecTimeout(timeout time.Duration) MsgOption {
+	return func(qm *QueueMsg) {
+		qm.ExecTimeout = int64(timeout / time.Millisecond)
+	}
 }
 
 // 队列接口
 type Queue interface {
 	EnQueue(model *QueueMsg, queuename string) error
+	EnQueueContext(ctx context.Context, model *QueueMsg, queuename string) error
 	DeQueue(queuename string) (string, *QueueMsg, error)
+	DeQueueContext(ctx context.Context, queuename string) (string, *QueueMsg, error)
 	BackQueue(model *QueueMsg, queuename string) error
+	BackQueueContext(ctx context.Context, model *QueueMsg, queuename string) error
+	Ack(qm *QueueMsg) error
+	Nack(qm *QueueMsg) error
+	DeadLetter(qm *QueueMsg, queuename, reason string, cause error) error
 	GetQueueMsg() (*QueueMsg, string)
+	GetQueueMsgContext(ctx context.Context) (*QueueMsg, string, error)
 	Quit()
+	Shutdown(ctx context.Context) error
 	IsRunning() bool
 	Start()
 }
@@ -70,13 +113,19 @@ type Queue interface {
 	weight:消息权重
 	retry:消息重试次数
 	queuename:消息队列名称
+	opts:消息的配置项，例如WithUniqueKey
 **/
-func EnQueueTask(q Queue, msg map[string]interface{}, weight, retry int, queuename string) (string, error) {
-	m, err := NewQueueMsg(msg, weight, retry)
+func EnQueueTask(q Queue, msg map[string]interface{}, weight, retry int, queuename string, opts ...MsgOption) (string, error) {
+	return EnQueueTaskContext(context.Background(), q, msg, weight, retry, queuename, opts...)
+}
+
+//入列，ctx的deadline会作为redis命令的超时时间
+func EnQueueTaskContext(ctx context.Context, q Queue, msg map[string]interface{}, weight, retry int, queuename string, opts ...MsgOption) (string, error) {
+	m, err := NewQueueMsg(msg, weight, retry, opts...)
 	if err != nil {
 		return "", err
 	}
-	err = q.EnQueue(m, queuename)
+	err = q.EnQueueContext(ctx, m, queuename)
 	return m.UUID, err
 }
 
@@ -84,25 +133,53 @@ func EnQueueTask(q Queue, msg map[string]interface{}, weight, retry int, queuena
 func DeQueueTask(q Queue) (qm *QueueMsg, qname string, err error) {
 	//会堵塞
 	qm, qname = q.GetQueueMsg()
-	if qm == nil || qm.Msg == nil {
+	return checkQueueMsg(q, qm, qname)
+}
+
+//消息出列，会堵塞到有消息、队列退出或者ctx结束
+func DeQueueTaskContext(ctx context.Context, q Queue) (qm *QueueMsg, qname string, err error) {
+	qm, qname, err = q.GetQueueMsgContext(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	return checkQueueMsg(q, qm, qname)
+}
+
+//检查出列的消息，过期的和没有消息体的消息进入死信队列
+func checkQueueMsg(q Queue, qm *QueueMsg, qname string) (*QueueMsg, string, error) {
+	if qm == nil {
 		return nil, "", nil
 	}
 
-	//消息超时处理
-	now := time.Now().Unix()
-	if qm.DeadTime > 0 && now > qm.DeadTime {
-		err = errors.New(fmt.Sprintf("Queue Error:TimeOut! Msg:", qm))
+	//没有消息体的消息没法处理，不进入死信队列的话会一直留在处理中列表
+	if qm.Msg == nil && qm.Body == nil {
+		logger.LogWarn(fmt.Sprintf("消息没有消息体,guid:%s,queue:%s", qm.UUID, qname))
 
-		return nil, "", err
+		if dlerr := q.DeadLetter(qm, qname, DeadReasonMalformed, ErrEmptyPayload); dlerr != nil {
+			logger.LogError(fmt.Sprintf("进入死信队列失败！%v,guid:%s", dlerr.Error(), qm.UUID))
+		}
+
+		return nil, "", ErrEmptyPayload
+	}
+
+	//消息超时处理，过期的消息进入死信队列
+	if qm.Expired() {
+		logger.LogWarn(fmt.Sprintf("消息已过期,guid:%s,queue:%s,dead_time:%d", qm.UUID, qname, qm.DeadTime))
+
+		if dlerr := q.DeadLetter(qm, qname, DeadReasonExpired, ErrMsgExpired); dlerr != nil {
+			logger.LogError(fmt.Sprintf("进入死信队列失败！%v,guid:%s", dlerr.Error(), qm.UUID))
+		}
+
+		return nil, "", ErrMsgExpired
 	}
 
 	return qm, qname, nil
 }
 
-// 消息返回队列
-func BackQueueTask(q Queue, msg map[string]interface{}, weight, retry int, queuename string) (string, error) {
+// 消息返回队列，需要保留消息头的用WithHeaders(qm.CopyHeaders())或者直接BackQueue原消息
+func BackQueueTask(q Queue, msg map[string]interface{}, weight, retry int, queuename string, opts ...MsgOption) (string, error) {
 
-	m, err := NewQueueMsg(msg, weight, retry)
+	m, err := NewQueueMsg(msg, weight, retry, opts...)
 	if err != nil {
 		return "", err
 	}
@@ -111,32 +188,60 @@ func BackQueueTask(q Queue, msg map[string]interface{}, weight, retry int, queue
 	return m.UUID, err
 }
 
+//重新计算过期时间，保持原来的有效期，创建时间改为现在，多次重新入列时有效期不会累加
+func refreshDeadTime(qm *QueueMsg) {
+	now := nowMillis()
+	if qm.DeadTime > 0 {
+		qm.DeadTime = now + qm.DeadTime - qm.Createdtime
+	}
+	qm.Createdtime = now
+}
+
 //消息错误处理
 func CatchError(q Queue, qm *QueueMsg, queuename string) {
+	var cause error
 	if err := recover(); err != nil {
 		logger.LogError(fmt.Sprintf("CacheError, err:%v", err))
 		logger.LogError(string(debug.Stack()))
+		cause = fmt.Errorf("panic: %v", err)
 	}
 
+	FailQueueTask(q, qm, queuename, cause)
+}
+
+//消息处理失败：重试次数没用完的返回消息队列，否则进入死信队列
+func FailQueueTask(q Queue, qm *QueueMsg, queuename string, cause error) {
 	if qm == nil {
 		return
 	}
 
-	//如果消息比较重要，返回消息队列
-	if qm.Weight >= BkWeight {
+	//不重要的消息直接确认掉
+	if qm.Weight < BkWeight {
+		q.Ack(qm)
+		return
+	}
 
-		if qm.Retry <= 0 {
-			logger.LogError(fmt.Sprintf("消息从新进入队列失败！原因：尝试处理次数 Retry:%d，  Msg:%#v,", qm.Retry, *qm))
-			return
+	//如果消息比较重要，返回消息队列
+	if qm.Retry <= 0 {
+		logger.LogError(fmt.Sprintf("消息从新进入队列失败！原因：尝试处理次数 Retry:%d，  Msg:%#v,", qm.Retry, *qm))
+		if err := q.DeadLetter(qm, queuename, DeadReasonRetryExhausted, cause); err != nil {
+			logger.LogError(fmt.Sprintf("进入死信队列失败！%v,guid:%s", err.Error(), qm.UUID))
 		}
+		return
+	}
 
-		qm.Retry--
-
-		err := q.BackQueue(qm, queuename)
-		logger.LogInfo(fmt.Sprintf("guid:%s 重新进入队列, :%v", qm.UUID))
+	qm.Retry--
+	qm.Attempt++
 
-		if err != nil {
-			logger.LogError(fmt.Sprintf("重新进入队列失败！%v,guid:%s", err.Error(), qm.UUID))
+	err := q.Nack(qm)
+	if err == ErrNotDelivered {
+		if err = backQueueRetry(q, qm, queuename); err == nil {
+			metricsOf(q).IncRetried(queuename)
 		}
 	}
+	logger.LogInfo(fmt.Sprintf("guid:%s 重新进入队列, queue:%s", qm.UUID, queuename))
+
+	if err != nil {
+		logger.LogError(fmt.Sprintf("重新进入队列失败！%v,guid:%s", err.Error(), qm.UUID))
+	}
 }
@@ -1,6 +1,7 @@
 package redisqueue
 
 import (
+	"context"
 	"testing"
 	"time"
 	"fmt"
@@ -30,7 +31,10 @@ var rQueue *RedisQueue
 
 func TestQueue(t *testing.T) {
 
-	qc := qqredis.NewRedisCache(addr, pw, 1000)
+	qc := qqredis.NewRedisCache(addr, pw, time.Hour, 0)
+	if _, err := qc.DoContext(context.Background(), "PING"); err != nil {
+		t.Skipf("redis %s not available: %v", addr, err)
+	}
 
 	//q1 :=[]string{platform_dequeuename,other_dequeuename,game_dequeue}
 	q2 := platform_dequeuename+","+other_dequeuename+","+game_dequeue
@@ -47,31 +51,28 @@ func TestQueue(t *testing.T) {
 
 	go startQueue()
 
-	for {
-		time.Sleep(100 * time.Second)
+	time.Sleep(5 * time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := rQueue.Shutdown(ctx); err != nil {
+		t.Fatal(err)
 	}
 }
 
 func startQueue() {
 
-	defer common.CacheError()
-	var qm *QueueMsg
-	var err error
-	var qname string
-
-	fn := func() {
-		defer CatchError(rQueue,qm,qname)
-		for {
+	w := NewWorker(rQueue, 4)
 
-			qm,qname, err = DeQueueTask(rQueue)
-			if err != nil || qm == nil {
-				continue
-			}
-			logger.LogInfo(fmt.Sprintf("qm::;>>>>>>>:%#v,***********\n%s", qm,qname))
-
-		}
+	handler := func(ctx context.Context, qm *QueueMsg) error {
+		logger.LogInfo(fmt.Sprintf("qm::;>>>>>>>:%#v,***********\n", qm))
+		return nil
 	}
-	go fn()
+	w.Handle(platform_dequeuename, handler)
+	w.Handle(other_dequeuename, handler)
+	w.Handle(game_dequeue, handler)
+
+	go w.Run(context.Background())
 }
 
 func enqueuet() {
@@ -79,7 +80,7 @@ func enqueuet() {
 	defer common.CacheError()
 	i := 0
 	num := 100
-	for {
+	for rQueue.IsRunning() {
 		i++
 		msg := map[string]interface{}{
 			"cmd":   "create_table",
@@ -103,7 +104,7 @@ func enqueuet2() {
 	defer common.CacheError()
 	i := 0
 	num := 100
-	for {
+	for rQueue.IsRunning() {
 		i++
 		msg := map[string]interface{}{
 			"cmd":   "create_table",
@@ -127,7 +128,7 @@ func enqueuet3() {
 	defer common.CacheError()
 	i := 0
 	num := 100
-	for {
+	for rQueue.IsRunning() {
 		i++
 		msg := map[string]interface{}{
 			"cmd":   "create_table",
@@ -0,0 +1,242 @@
+package redisqueue
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/weikaishio/go-logger/logger"
+)
+
+const (
+	DefaultVisibilityTimeout = 5 * time.Minute  //消息处理超时时间，超过后会被重新放回队列
+	DefaultHeartbeatTTL      = 30 * time.Second //消费者心跳的有效期
+	DefaultReapInterval      = 30 * time.Second //回收检查的间隔
+)
+
+var (
+	errVisibilityTimeout = errors.New("redisqueue: visibility timeout exceeded")
+	errConsumerDead      = errors.New("redisqueue: consumer heartbeat expired")
+)
+
+//注册消费者并刷新心跳
+var heartbeatScript = redis.NewScript(2, `
+redis.call('SADD', KEYS[1], ARGV[1])
+redis.call('SET', KEYS[2], ARGV[2], 'PX', ARGV[3])
+return 1
+`)
+
+//把处理中的消息放回原队列或者死信队列（只有消息还在处理中列表时才会放回，避免重复）
+//设置了到期时间的放到延迟队列
+var recoverScript = redis.NewScript(4, `
+if redis.call('LREM', KEYS[1], 1, ARGV[1]) == 0 then
+	return 0
+end
+redis.call('ZREM', KEYS[2], ARGV[1])
+if ARGV[2] == '' then
+	return 1
+end
+if ARGV[4] == '0' then
+	redis.call(ARGV[3], KEYS[3], ARGV[2])
+else
+	redis.call('ZADD', KEYS[4], ARGV[4], ARGV[2])
+end
+return 1
+`)
+
+//处理中列表为空时注销已经死掉的消费者
+var unregisterScript = redis.NewScript(3, `
+if redis.call('LLEN', KEYS[2]) > 0 then
+	return 0
+end
+redis.call('DEL', KEYS[3])
+redis.call('SREM', KEYS[1], ARGV[1])
+return 1
+`)
+
+//队列的消费者集合
+func consumersKey(queuename string) string {
+	return queuename + ":consumers"
+}
+
+//消费者的心跳
+func heartbeatKey(queuename, consumerID string) string {
+	return queuename + ":heartbeat:" + consumerID
+}
+
+//处理中列表的出列时间（有序集合，分数为毫秒时间戳）
+func processingTsKey(pkey string) string {
+	return pkey + ":ts"
+}
+
+func (q *RedisQueue) heartbeat() {
+	for _, name := range q.queueNames() {
+		q.beat(name)
+	}
+}
+
+//注册消费者并刷新一个队列的心跳
+func (q *RedisQueue) beat(queuename string) {
+	now := nowMillis()
+	q.mu.Lock()
+	q.beats[queuename] = now
+	q.mu.Unlock()
+
+	ttl := int64(q.heartbeatTTL / time.Millisecond)
+	_, err := q.redisclient.Eval(heartbeatScript, consumersKey(queuename), heartbeatKey(queuename, q.consumerID), q.consumerID, now, ttl)
+	if err != nil {
+		logger.LogWarn(fmt.Sprintf("RedisQueue heartbeat error: %v, queue:%s", err, queuename))
+	}
+}
+
+//出列前注册消费者，直接用DeQueue消费没有Start过的队列时，处理中列表同样能被回收
+//心跳超过有效期的1/3才刷新，避免每次出列都多一次redis调用
+func (q *RedisQueue) register(queuename string) {
+	q.mu.Lock()
+	last, ok := q.beats[queuename]
+	q.mu.Unlock()
+	if ok && nowMillis()-last < int64(q.heartbeatTTL/3/time.Millisecond) {
+		return
+	}
+	q.beat(queuename)
+}
+
+//注册过消费者的队列：Start的队列以及出列过的队列
+func (q *RedisQueue) queueNames() []string {
+	names := append([]string(nil), q.deQueueName...)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for name := range q.beats {
+		if !containsString(q.deQueueName, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+//定时刷新心跳
+func (q *RedisQueue) runHeartbeat() {
+	interval := q.heartbeatTTL / 3
+	for q.IsRunning() {
+		q.heartbeat()
+		if !q.sleep(interval) {
+			return
+		}
+	}
+}
+
+//定时回收超时未确认的消息
+func (q *RedisQueue) runReaper() {
+	for q.IsRunning() {
+		for _, name := range q.queueNames() {
+			if err := q.Reap(name); err != nil {
+				logger.LogWarn(fmt.Sprintf("RedisQueue reap error: %v, queue:%s", err, name))
+			}
+		}
+		if !q.sleep(q.reapInterval) {
+			return
+		}
+	}
+}
+
+//回收一个队列里的消息：心跳过期的消费者的全部消息，以及处理超过可见超时的消息
+//消费者在出列时注册到队列的消费者集合，没有Start的队列也可以定时调用Reap回收
+func (q *RedisQueue) Reap(queuename string) error {
+	consumers, err := q.redisclient.Smembers(consumersKey(queuename))
+	if err != nil {
+		return err
+	}
+
+	deadline := nowMillis() - int64(q.visibilityTimeout/time.Millisecond)
+
+	for _, consumer := range consumers {
+		pkey := processingKey(queuename, consumer)
+		tskey := processingTsKey(pkey)
+
+		alive, err := q.redisclient.Exists(heartbeatKey(queuename, consumer))
+		if err != nil {
+			return err
+		}
+
+		var items []interface{}
+		cause := errConsumerDead
+		if alive {
+			cause = errVisibilityTimeout
+			items, err = q.redisclient.Zrangebyscore(tskey, 0, deadline)
+		} else {
+			items, err = q.redisclient.Lrange(pkey, 0, -1)
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, it := range items {
+			raw, err := redis.Bytes(it, nil)
+			if err != nil {
+				continue
+			}
+			q.recoverMsg(queuename, pkey, tskey, raw, cause)
+		}
+
+		if !alive {
+			q.redisclient.Eval(unregisterScript, consumersKey(queuename), pkey, tskey, consumer)
+		}
+	}
+	return nil
+}
+
+//把一条处理中的消息放回队列，重试次数减一，重试次数用完的进入死信队列
+func (q *RedisQueue) recoverMsg(queuename, pkey, tskey string, raw []byte, cause error) {
+	var bt []byte
+	var target, cmd string
+	var due int64
+
+	qm := new(QueueMsg)
+	if err := decodeMsg(raw, qm); err != nil {
+		//无法解析的消息直接丢弃
+		logger.LogError(fmt.Sprintf("RedisQueue reap unmarshal error: %v, item:%s", err, raw))
+	} else {
+		if qm.Retry <= 0 {
+			logger.LogError(fmt.Sprintf("消息回收失败！原因：尝试处理次数 Retry:%d，  guid:%s", qm.Retry, qm.UUID))
+			target, cmd = q.DeadQueueName(queuename), "LPUSH"
+			bt, err = json.Marshal(newDeadMsg(qm, queuename, DeadReasonRetryExhausted, cause))
+		} else {
+			qm.Retry--
+			qm.Attempt++
+			target, cmd = q.readyKey(queuename, qm.Weight), "RPUSH"
+			due = q.retryPolicy.due(qm.Attempt)
+			bt, err = encodeMsg(q.codecFor(queuename), qm)
+		}
+		if err != nil {
+			logger.LogError(fmt.Sprintf("RedisQueue reap marshal error: %v, guid:%s", err, qm.UUID))
+			return
+		}
+	}
+
+	moved, err := redis.Int(q.redisclient.Eval(recoverScript, pkey, tskey, target, delayedKey(target), raw, bt, cmd, due))
+	if err != nil {
+		logger.LogWarn(fmt.Sprintf("RedisQueue recover error: %v, guid:%s", err, qm.UUID))
+		return
+	}
+	if moved == 1 && cmd == "LPUSH" {
+		releaseUnique(q.redisclient, qm, queuename)
+		q.metrics.IncDeadLettered(queuename, DeadReasonRetryExhausted)
+	}
+	if moved == 1 && cmd == "RPUSH" {
+		q.metrics.IncRetried(queuename)
+	}
+	if moved == 1 && bt != nil {
+		logger.LogInfo(fmt.Sprintf("guid:%s 处理超时，进入队列:%s", qm.UUID, target))
+	}
+}
@@ -0,0 +1,87 @@
+package redisqueue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReapVisibilityTimeout(t *testing.T) {
+	s, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, "", WithVisibilityTimeout(time.Millisecond), WithRetryPolicy(RetryPolicy{}))
+
+	//没有Start，直接出列的队列也要能回收
+	guid, _ := EnQueueTask(q, map[string]interface{}{"n": 1}, 1, 1, "rp")
+	_, qm, _ := q.DeQueue("rp")
+	if qm == nil {
+		t.Fatal("no message")
+	}
+	if ok, _ := s.SIsMember(consumersKey("rp"), q.consumerID); !ok {
+		t.Fatal("consumer not registered on dequeue")
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	if err := q.Reap("rp"); err != nil {
+		t.Fatal(err)
+	}
+	if n, ts := inProcessing(t, q, "rp"); n != 0 || ts != 0 {
+		t.Fatalf("after reap processing = %d, ts = %d, want 0", n, ts)
+	}
+	if err := q.Ack(qm); err != nil {
+		t.Errorf("late ack err = %v", err)
+	}
+
+	_, qm, _ = q.DeQueue("rp")
+	if qm == nil || qm.UUID != guid || qm.Retry != 0 || qm.Attempt != 1 {
+		t.Fatalf("recovered %+v", qm)
+	}
+
+	//重试次数用完进入死信队列
+	time.Sleep(5 * time.Millisecond)
+	if err := q.Reap("rp"); err != nil {
+		t.Fatal(err)
+	}
+	dms, _ := q.DeadMsgs("rp", 0, -1)
+	if len(dms) != 1 || dms[0].Msg.UUID != guid || dms[0].Reason != DeadReasonRetryExhausted || dms[0].LastError != errVisibilityTimeout.Error() {
+		t.Fatalf("dead = %+v", dms)
+	}
+	if items, _ := s.List("rp"); len(items) != 0 {
+		t.Errorf("ready = %v, want empty", items)
+	}
+}
+
+func TestReapDeadConsumer(t *testing.T) {
+	s, rc := newTestRedis(t)
+	dead := NewRedisQueue(rc, "", WithRetryPolicy(RetryPolicy{}))
+	alive := NewRedisQueue(rc, "", WithRetryPolicy(RetryPolicy{}))
+
+	EnQueueTask(dead, map[string]interface{}{"n": 1}, 1, 1, "rp")
+	_, qm, _ := dead.DeQueue("rp")
+	if qm == nil {
+		t.Fatal("no message")
+	}
+
+	//没到可见超时，心跳还在时不回收
+	if err := alive.Reap("rp"); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := inProcessing(t, dead, "rp"); n != 1 {
+		t.Fatalf("processing = %d, want 1", n)
+	}
+
+	s.FastForward(DefaultHeartbeatTTL + time.Second)
+	if err := alive.Reap("rp"); err != nil {
+		t.Fatal(err)
+	}
+	if n, ts := inProcessing(t, dead, "rp"); n != 0 || ts != 0 {
+		t.Fatalf("after reap processing = %d, ts = %d, want 0", n, ts)
+	}
+	//处理中列表清空后注销
+	if ok, _ := s.SIsMember(consumersKey("rp"), dead.consumerID); ok {
+		t.Error("dead consumer still registered")
+	}
+
+	_, got, _ := alive.DeQueue("rp")
+	if got == nil || got.UUID != qm.UUID || got.Attempt != 1 {
+		t.Errorf("recovered %+v", got)
+	}
+}
@@ -1,12 +1,18 @@
 package redisqueue
 
 import (
+	"context"
+	"sync"
 	"sync/atomic"
 	"time"
 	"fmt"
+	"os"
 
+	"github.com/garyburd/redigo/redis"
+	"github.com/satori/go.uuid"
 	"github.com/weikaishio/go-logger/logger"
-	"encoding/json"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"errors"
 	"hallversion/common/qqredis"
 	"strings"
@@ -17,11 +23,136 @@ const (
 	PullQueueErrTime   = 1
 )
 
+var (
+	ErrNotDelivered = errors.New("redisqueue: message was not delivered by this queue")
+	ErrNotInFlight  = errors.New("redisqueue: message is not in processing list")
+)
+
+//从处理中列表删除消息
+var ackScript = redis.NewScript(2, `
+local n = redis.call('LREM', KEYS[1], 1, ARGV[1])
+redis.call('ZREM', KEYS[2], ARGV[1])
+return n
+`)
+
+//把消息从处理中列表移回原队列的队首，设置了到期时间的放到延迟队列
+var nackScript = redis.NewScript(4, `
+if redis.call('LREM', KEYS[1], 1, ARGV[1]) == 0 then
+	return 0
+end
+redis.call('ZREM', KEYS[2], ARGV[1])
+if ARGV[3] == '0' then
+	redis.call('RPUSH', KEYS[3], ARGV[2])
+else
+	redis.call('ZADD', KEYS[4], ARGV[3], ARGV[2])
+end
+return 1
+`)
+
 type RedisQueue struct {
 	redisclient qqredis.RedisCache
 	deQueueName []string
+	consumerID  string
 	running     int32
 	msgque      chan backmsg
+	quit        chan struct{}
+	quitOnce    sync.Once
+	fetchers    sync.WaitGroup
+
+	mu       sync.Mutex
+	inflight map[*QueueMsg]struct{}
+	beats    map[string]int64 //注册过消费者的队列以及最后一次心跳的时间
+
+	visibilityTimeout time.Duration
+	heartbeatTTL      time.Duration
+	reapInterval      time.Duration
+	deadSuffix        string
+	promoteInterval   time.Duration
+	retryPolicy       RetryPolicy
+	priorityLevels    int
+	popMode           PopMode
+	queueWeights      map[string]int
+	popCount          uint64
+	codec             Codec
+	queueCodecs       map[string]Codec
+	metrics           Metrics
+	depthInterval     time.Duration
+	tracerProvider    trace.TracerProvider
+	propagator        propagation.TextMapPropagator
+
+	enqueueMiddlewares []EnqueueMiddleware
+	streamMaxLen       int64
+	streamApprox       bool
+}
+
+// RedisQueue的配置项
+type QueueOption func(*RedisQueue)
+
+//消息出列后超过该时间未确认，会被重新放回队列
+func WithVisibilityTimeout(d time.Duration) QueueOption {
+	return func(q *RedisQueue) {
+		q.visibilityTimeout = d
+	}
+}
+
+//消费者心跳有效期，心跳过期的消费者的消息会全部被回收
+func WithHeartbeatTTL(d time.Duration) QueueOption {
+	return func(q *RedisQueue) {
+		q.heartbeatTTL = d
+	}
+}
+
+//回收检查的间隔
+func WithReapInterval(d time.Duration) QueueOption {
+	return func(q *RedisQueue) {
+		q.reapInterval = d
+	}
+}
+
+//检查延迟消息是否到期的间隔
+func WithPromoteInterval(d time.Duration) QueueOption {
+	return func(q *RedisQueue) {
+		q.promoteInterval = d
+	}
+}
+
+//消息处理失败后的重试策略，默认为DefaultRetryPolicy，零值为立即重试
+func WithRetryPolicy(p RetryPolicy) QueueOption {
+	return func(q *RedisQueue) {
+		q.retryPolicy = p
+	}
+}
+
+//开启优先级模式，levels为优先级数量，消息按Weight分到不同的子队列，Weight高的先出列
+//生产者和消费者需要使用相同的配置
+func WithPriorityLevels(levels int) QueueOption {
+	return func(q *RedisQueue) {
+		q.priorityLevels = levels
+	}
+}
+
+//消息的编码方式，默认为json
+func WithCodec(c Codec) QueueOption {
+	return func(q *RedisQueue) {
+		q.codec = c
+	}
+}
+
+//单独设置某个队列的编码方式
+func WithQueueCodec(queuename string, c Codec) QueueOption {
+	return func(q *RedisQueue) {
+		if q.queueCodecs == nil {
+			q.queueCodecs = make(map[string]Codec)
+		}
+		q.queueCodecs[queuename] = c
+	}
+}
+
+//死信队列的后缀，死信队列名称为 队列名称+后缀
+func WithDeadLetterSuffix(suffix string) QueueOption {
+	return func(q *RedisQueue) {
+		q.deadSuffix = suffix
+	}
 }
 
 type backmsg struct {
@@ -29,29 +160,88 @@ type backmsg struct {
 	queName string
 }
 
-func NewRedisQueue(rc qqredis.RedisCache, deQueueName string) *RedisQueue {
+func NewRedisQueue(rc qqredis.RedisCache, deQueueName string, opts ...QueueOption) *RedisQueue {
 
 	redisqueue := &RedisQueue{}
 
 	redisqueue.deQueueName = strings.Split(deQueueName, ",")
 
+	redisqueue.consumerID = newConsumerID()
+
 	redisqueue.running = 1
 
 	redisqueue.redisclient = rc
 
 	redisqueue.msgque = make(chan backmsg, 10)
 
+	redisqueue.quit = make(chan struct{})
+
+	redisqueue.inflight = make(map[*QueueMsg]struct{})
+
+	redisqueue.beats = make(map[string]int64)
+
+	redisqueue.visibilityTimeout = DefaultVisibilityTimeout
+	redisqueue.heartbeatTTL = DefaultHeartbeatTTL
+	redisqueue.reapInterval = DefaultReapInterval
+	redisqueue.deadSuffix = DefaultDeadLetterSuffix
+	redisqueue.promoteInterval = DefaultPromoteInterval
+	redisqueue.retryPolicy = DefaultRetryPolicy
+	redisqueue.codec = JSONCodec
+	redisqueue.metrics = NopMetrics{}
+	redisqueue.depthInterval = DefaultDepthInterval
+
+	for _, opt := range opts {
+		opt(redisqueue)
+	}
+
 	return redisqueue
 }
 
+//消费者标识：主机名-进程号-随机串
+func newConsumerID() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "unknown"
+	}
+	id, _ := uuid.NewV4()
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), id.String()[:8])
+}
+
+//队列入列时使用的编码方式，出列时按消息的标记解码
+func (q *RedisQueue) codecFor(queuename string) Codec {
+	if c, ok := q.queueCodecs[queuename]; ok {
+		return c
+	}
+	return q.codec
+}
+
+//当前毫秒时间戳
+func nowMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+//处理中列表，每个消费者每个队列一个
+func processingKey(queuename, consumerID string) string {
+	return queuename + ":processing:" + consumerID
+}
+
 func (q *RedisQueue) RedisCache() qqredis.RedisCache {
 	return q.redisclient
 }
 
+//当前消费者标识
+func (q *RedisQueue) ConsumerID() string {
+	return q.consumerID
+}
+
+//停止拉取消息，不等待处理中的消息，需要等待的使用Shutdown
 func (q *RedisQueue) Quit() {
-	logger.LogInfo("RedisQueue %s %s ready quit", q.deQueueName)
+	logger.LogInfo(fmt.Sprintf("RedisQueue %v ready quit", q.deQueueName))
 	atomic.StoreInt32(&q.running, 0)
-	logger.LogInfo("RedisQueue %s %s quit ok", q.deQueueName)
+	q.quitOnce.Do(func() {
+		close(q.quit)
+	})
+	logger.LogInfo(fmt.Sprintf("RedisQueue %v quit ok", q.deQueueName))
 }
 
 //运行状态
@@ -61,29 +251,125 @@ func (q *RedisQueue) IsRunning() bool {
 
 //入列
 func (q *RedisQueue) EnQueue(model *QueueMsg, queuename string) error {
-	bt, err := json.Marshal(model)
+	return q.EnQueueContext(context.Background(), model, queuename)
+}
+
+//入列，ctx的deadline会作为redis命令的超时时间
+func (q *RedisQueue) EnQueueContext(ctx context.Context, model *QueueMsg, queuename string) error {
+	return q.enqueueWith(ctx, model, queuename, q.push)
+}
+
+func (q *RedisQueue) push(ctx context.Context, model *QueueMsg, queuename string) (err error) {
+	ctx, span := startProducerSpan(ctx, q, model, queuename)
+	defer func() { qqredis.EndSpan(span, err) }()
+
+	bt, err := encodeMsg(q.codecFor(queuename), model)
 	if err != nil {
 		return err
 	}
-	return q.redisclient.Lpush(queuename, bt)
+	ready := q.readyKey(queuename, model.Weight)
+	if model.UniqueKey != "" {
+		err = pushUnique(ctx, q.redisclient, model, queuename, ready, bt, "LPUSH")
+	} else {
+		_, err = q.redisclient.DoContext(ctx, "LPUSH", ready, bt)
+	}
+	if err == nil {
+		q.metrics.IncEnqueued(queuename)
+	}
+	return err
 }
 
 //返回队列
 func (q *RedisQueue) BackQueue(model *QueueMsg, queuename string) error {
-	bt, err := json.Marshal(model)
+	return q.BackQueueContext(context.Background(), model, queuename)
+}
+
+//返回队列，ctx的deadline会作为redis命令的超时时间
+func (q *RedisQueue) BackQueueContext(ctx context.Context, model *QueueMsg, queuename string) error {
+	bt, err := encodeMsg(q.codecFor(queuename), model)
 
 	if err != nil {
 		return err
 	}
 
-	return q.redisclient.Rpush(queuename, bt)
+	_, err = q.redisclient.DoContext(ctx, "RPUSH", q.readyKey(queuename, model.Weight), bt)
+	return err
 }
 
-func (q *RedisQueue) GetQueueMsg() (*QueueMsg, string) {
+//按重试策略放回队列，需要延迟的放到延迟队列
+func (q *RedisQueue) backQueueRetry(ctx context.Context, model *QueueMsg, queuename string) error {
+	due := q.retryPolicy.due(model.Attempt)
+	if due == 0 {
+		return q.BackQueueContext(ctx, model, queuename)
+	}
 
-	qmg := <-q.msgque
+	bt, err := encodeMsg(q.codecFor(queuename), model)
+	if err != nil {
+		return err
+	}
+	_, err = q.redisclient.DoContext(ctx, "ZADD", delayedKey(q.readyKey(queuename, model.Weight)), due, bt)
+	return err
+}
 
-	return qmg.msg, qmg.queName
+//确认消息处理完成，从处理中列表删除
+func (q *RedisQueue) Ack(qm *QueueMsg) error {
+	if qm == nil || qm.processing == "" {
+		return ErrNotDelivered
+	}
+	q.untrack(qm)
+	_, err := q.redisclient.EvalContext(msgContext(qm), ackScript, qm.processing, processingTsKey(qm.processing), qm.raw)
+	if err == nil {
+		releaseUnique(q.redisclient, qm, qm.queue)
+		q.metrics.IncAcked(qm.queue)
+		q.metrics.ObserveEndToEndLatency(qm.queue, sinceCreated(qm))
+	}
+	return err
+}
+
+//消息处理失败，从处理中列表移回原队列（会带上qm当前的字段，例如Retry）
+//按重试策略和qm.Attempt计算延迟，需要延迟的放到延迟队列
+func (q *RedisQueue) Nack(qm *QueueMsg) error {
+	if qm == nil || qm.processing == "" {
+		return ErrNotDelivered
+	}
+
+	bt, err := encodeMsg(q.codecFor(qm.queue), qm)
+	if err != nil {
+		return err
+	}
+
+	q.untrack(qm)
+
+	ready := q.readyKey(qm.queue, qm.Weight)
+	moved, err := redis.Int(q.redisclient.EvalContext(msgContext(qm), nackScript, qm.processing, processingTsKey(qm.processing), ready, delayedKey(ready), qm.raw, bt, q.retryPolicy.due(qm.Attempt)))
+	if err != nil {
+		return err
+	}
+	if moved == 0 {
+		return ErrNotInFlight
+	}
+	q.metrics.IncRetried(qm.queue)
+	return nil
+}
+
+//获取消息，会堵塞，队列退出后返回nil
+func (q *RedisQueue) GetQueueMsg() (*QueueMsg, string) {
+	qm, qname, _ := q.GetQueueMsgContext(context.Background())
+	return qm, qname
+}
+
+//获取消息，会堵塞到有消息、队列退出或者ctx结束
+func (q *RedisQueue) GetQueueMsgContext(ctx context.Context) (*QueueMsg, string, error) {
+
+	select {
+	case qmg := <-q.msgque:
+		q.track(qmg.msg)
+		return qmg.msg, qmg.queName, nil
+	case <-q.quit:
+		return nil, "", nil
+	case <-ctx.Done():
+		return nil, "", ctx.Err()
+	}
 }
 
 func (q *RedisQueue) Start() {
@@ -92,59 +378,165 @@ func (q *RedisQueue) Start() {
 		return
 	}
 
+	//先注册心跳，避免刚出列的消息被其他节点当成死掉的消费者回收
+	q.heartbeat()
+	go q.runHeartbeat()
+	go q.runReaper()
+	go q.runPromoter()
+	go q.runDepthSampler()
+
+	//单连接模式，一个BRPOP监听全部队列
+	if q.popMode != PopPerQueue {
+		q.fetchers.Add(1)
+		go q.fetch(q.dequeueMulti, q.release)
+		return
+	}
+
 	for i := 0; i < len(q.deQueueName); i++ {
+		name := q.deQueueName[i]
+		q.fetchers.Add(1)
+		go q.fetch(func() (string, *QueueMsg, error) {
+			return q.DeQueue(name)
+		}, q.release)
+	}
+}
+
+//循环拉取消息放到本地队列，退出时用release把没交出去的消息放回
+func (q *RedisQueue) fetch(dequeue func() (string, *QueueMsg, error), release func(*QueueMsg) error) {
+	defer q.fetchers.Done()
 
-		fun := func(index int) {
-			for {
-				quename, msg, err := q.DeQueue(q.deQueueName[index])
+	for q.IsRunning() {
+		quename, msg, err := dequeue()
 
-				if err != nil || msg == nil {
+		if err != nil || msg == nil {
 
-					continue
-				}
+			continue
+		}
 
-				mst := backmsg{
-					queName: quename,
-					msg:     msg,
-				}
+		mst := backmsg{
+			queName: quename,
+			msg:     msg,
+		}
 
-				q.msgque <- mst
+		select {
+		case q.msgque <- mst:
+		case <-q.quit:
+			//已经退出，消息放回队列
+			if err := release(msg); err != nil {
+				logger.LogError(fmt.Sprintf("RedisQueue release error: %v, guid:%s", err, msg.UUID))
 			}
+			return
 		}
-		go fun(i)
 	}
 }
 
-//出列
+//出列，消息会被移到当前消费者的处理中列表，处理完成后需要Ack
+//最多堵塞PullQueueBlockTime秒，没有消息时返回nil
 func (q *RedisQueue) DeQueue(queuename string) (string, *QueueMsg, error) {
+	return q.dequeue(context.Background(), queuename, PullQueueBlockTime*time.Second)
+}
 
-	model := new(QueueMsg)
-	qn := ""
-
-	if q.IsRunning() {
-		var err = errors.New("")
-		var item = []byte{}
-		qn, item, err = q.redisclient.BRpop(queuename, PullQueueBlockTime)
-
-		if err != nil {
-
-			if err.Error() != "redigo: nil returned" {
-				logger.LogWarn(fmt.Sprintf("RedisQueue error: %v", err))
-				time.Sleep(PullQueueErrTime * time.Second)
+//出列，会堵塞到有消息、队列退出或者ctx结束
+func (q *RedisQueue) DeQueueContext(ctx context.Context, queuename string) (string, *QueueMsg, error) {
+	for q.IsRunning() {
+		//每次最多堵塞1秒，及时响应ctx取消
+		block := time.Second
+		if deadline, ok := ctx.Deadline(); ok {
+			if remain := time.Until(deadline); remain < block {
+				block = remain
 			}
+		}
 
+		qname, qm, err := q.dequeue(ctx, queuename, block)
+		if err != nil || qm != nil {
+			return qname, qm, err
+		}
+		if err := ctx.Err(); err != nil {
 			return "", nil, err
 		}
+	}
+	return "", nil, nil
+}
+
+func (q *RedisQueue) dequeue(ctx context.Context, queuename string, block time.Duration) (string, *QueueMsg, error) {
+
+	if !q.IsRunning() {
+		return "", nil, nil
+	}
 
-		if item == nil {
-			return "", nil, nil
+	q.register(queuename)
+
+	var item []byte
+	var err error
+	pkey := processingKey(queuename, q.consumerID)
+	if q.priorityLevels > 1 {
+		item, err = q.popPriority(ctx, queuename, pkey, block)
+	} else {
+		item, err = q.popLpush(ctx, queuename, pkey, block)
+	}
+
+	if err != nil {
+
+		if err != context.Canceled && err != context.DeadlineExceeded {
+			logger.LogWarn(fmt.Sprintf("RedisQueue error: %v", err))
+			q.sleep(PullQueueErrTime * time.Second)
 		}
 
-		err = json.Unmarshal(item, model)
+		return "", nil, err
+	}
 
-		if err != nil {
-			return "", nil, err
+	if item == nil {
+		return "", nil, nil
+	}
+
+	//记录出列时间，用于超时回收
+	if _, err := q.redisclient.DoContext(ctx, "ZADD", processingTsKey(pkey), nowMillis(), item); err != nil {
+		logger.LogWarn(fmt.Sprintf("RedisQueue record dequeue time error: %v", err))
+	}
+
+	return q.deliver(queuename, pkey, item)
+}
+
+//从队列取出一条消息放到处理中列表，最多堵塞block
+func (q *RedisQueue) popLpush(ctx context.Context, queuename, pkey string, block time.Duration) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var raw interface{}
+	var err error
+	if sec := int(block / time.Second); sec > 0 {
+		//堵塞时间已经按ctx的deadline算好，这里不再用deadline作为读超时
+		raw, err = q.redisclient.DoContext(context.Background(), "BRPOPLPUSH", queuename, pkey, sec)
+	} else {
+		//BRPOPLPUSH最小只能等1秒，不足1秒时取不到就等到block结束
+		raw, err = q.redisclient.DoContext(ctx, "RPOPLPUSH", queuename, pkey)
+		if err == nil && raw == nil {
+			q.sleepContext(ctx, block)
 		}
 	}
-	return qn, model, nil
+	if err != nil || raw == nil {
+		return nil, err
+	}
+	return redis.Bytes(raw, nil)
+}
+
+//解析已经放到处理中列表的消息
+func (q *RedisQueue) deliver(queuename, pkey string, item []byte) (string, *QueueMsg, error) {
+	model := new(QueueMsg)
+	err := decodeMsg(item, model)
+
+	if err != nil {
+		//无法解析的消息留在处理中列表会一直卡住，直接丢弃
+		logger.LogError(fmt.Sprintf("RedisQueue unmarshal error: %v, item:%s", err, item))
+		q.redisclient.Eval(ackScript, pkey, processingTsKey(pkey), item)
+		return "", nil, err
+	}
+
+	model.raw = item
+	model.queue = queuename
+	model.processing = pkey
+
+	q.metrics.IncDequeued(queuename)
+	return queuename, model, nil
 }
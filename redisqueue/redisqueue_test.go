@@ -0,0 +1,77 @@
+package redisqueue
+
+import (
+	"testing"
+)
+
+//处理中列表和出列时间里的消息数
+func inProcessing(t *testing.T, q *RedisQueue, queuename string) (int, int) {
+	t.Helper()
+	pkey := processingKey(queuename, q.consumerID)
+	n, err := q.redisclient.Llen(pkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, err := q.redisclient.Zcard(processingTsKey(pkey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n, ts
+}
+
+func TestAck(t *testing.T) {
+	s, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, "ack")
+
+	guid, _ := EnQueueTask(q, map[string]interface{}{"n": 1}, 1, 1, "ack")
+	qname, qm, err := q.DeQueue("ack")
+	if err != nil || qm == nil || qm.UUID != guid || qname != "ack" {
+		t.Fatalf("DeQueue = %q, %+v, %v", qname, qm, err)
+	}
+	if n, ts := inProcessing(t, q, "ack"); n != 1 || ts != 1 {
+		t.Fatalf("processing = %d, ts = %d, want 1", n, ts)
+	}
+
+	if err := q.Ack(qm); err != nil {
+		t.Fatal(err)
+	}
+	if n, ts := inProcessing(t, q, "ack"); n != 0 || ts != 0 {
+		t.Errorf("after ack processing = %d, ts = %d, want 0", n, ts)
+	}
+	if items, _ := s.List("ack"); len(items) != 0 {
+		t.Errorf("ready = %v, want empty", items)
+	}
+	if err := q.Ack(&QueueMsg{}); err != ErrNotDelivered {
+		t.Errorf("ack undelivered err = %v, want ErrNotDelivered", err)
+	}
+}
+
+func TestNack(t *testing.T) {
+	s, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, "nack", WithRetryPolicy(RetryPolicy{}))
+
+	EnQueueTask(q, map[string]interface{}{"n": 1}, 1, 1, "nack")
+	EnQueueTask(q, map[string]interface{}{"n": 2}, 1, 1, "nack")
+	_, qm, _ := q.DeQueue("nack")
+
+	qm.Retry--
+	qm.Attempt++
+	if err := q.Nack(qm); err != nil {
+		t.Fatal(err)
+	}
+	if n, ts := inProcessing(t, q, "nack"); n != 0 || ts != 0 {
+		t.Errorf("after nack processing = %d, ts = %d, want 0", n, ts)
+	}
+	if err := q.Nack(qm); err != ErrNotInFlight {
+		t.Errorf("nack twice err = %v, want ErrNotInFlight", err)
+	}
+
+	//放回队首，下一次先出列
+	_, got, _ := q.DeQueue("nack")
+	if got == nil || got.UUID != qm.UUID || got.Retry != 0 || got.Attempt != 1 {
+		t.Errorf("redelivered %+v", got)
+	}
+	if items, _ := s.List("nack"); len(items) != 1 {
+		t.Errorf("ready = %d, want 1", len(items))
+	}
+}
@@ -0,0 +1,79 @@
+package redisqueue
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// 消息处理失败后的重试策略，第n次重试的延迟为 BaseDelay*Multiplier^(n-1)，最大不超过MaxDelay
+type RetryPolicy struct {
+	BaseDelay  time.Duration //第一次重试的延迟，为0时立即重试
+	Multiplier float64       //每次重试延迟的倍数
+	MaxDelay   time.Duration //最大延迟，为0时不限制
+	Jitter     float64       //随机浮动的比例（0~1），避免大量消息同时重试
+}
+
+//队列默认的重试策略，需要立即重试的使用WithRetryPolicy(RetryPolicy{})
+var DefaultRetryPolicy = RetryPolicy{
+	BaseDelay:  time.Second,
+	Multiplier: 2,
+	MaxDelay:   5 * time.Minute,
+	Jitter:     0.2,
+}
+
+//第attempt次重试的延迟，attempt从1开始
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	if p.BaseDelay <= 0 {
+		return 0
+	}
+	if attempt < 1 {
+		attempt = 1
+	}
+
+	mult := p.Multiplier
+	if mult < 1 {
+		mult = 1
+	}
+
+	delay := float64(p.BaseDelay) * math.Pow(mult, float64(attempt-1))
+	if p.Jitter > 0 {
+		jitter := math.Min(p.Jitter, 1)
+		delay *= 1 + jitter*(2*rand.Float64()-1)
+	}
+
+	//浮动之后再限制，保证不超过MaxDelay
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+
+	//没有MaxDelay时重试次数多了会溢出
+	if delay >= math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(delay)
+}
+
+//第attempt次重试的到期时间（毫秒时间戳），不需要延迟时为0
+func (p RetryPolicy) due(attempt int) int64 {
+	delay := p.Delay(attempt)
+	if delay <= 0 {
+		return 0
+	}
+	if ms := int64(delay / time.Millisecond); ms < math.MaxInt64-nowMillis() {
+		return nowMillis() + ms
+	}
+	return math.MaxInt64
+}
+
+//不是由队列投递的消息（Nack返回ErrNotDelivered）处理失败后放回队列
+//队列支持重试策略时按策略延迟，否则立即放回
+func backQueueRetry(q Queue, qm *QueueMsg, queuename string) error {
+	if r, ok := q.(interface {
+		backQueueRetry(ctx context.Context, model *QueueMsg, queuename string) error
+	}); ok {
+		return r.backQueueRetry(context.Background(), qm, queuename)
+	}
+	return q.BackQueue(qm, queuename)
+}
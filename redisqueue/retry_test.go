@@ -0,0 +1,81 @@
+package redisqueue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{BaseDelay: time.Second, Multiplier: 2, MaxDelay: 10 * time.Second}
+
+	cases := map[int]time.Duration{
+		0: time.Second,
+		1: time.Second,
+		2: 2 * time.Second,
+		3: 4 * time.Second,
+		4: 8 * time.Second,
+		5: 10 * time.Second,
+		9: 10 * time.Second,
+	}
+	for attempt, want := range cases {
+		if got := p.Delay(attempt); got != want {
+			t.Errorf("Delay(%d) = %v, want %v", attempt, got, want)
+		}
+	}
+}
+
+func TestRetryPolicyJitter(t *testing.T) {
+	p := RetryPolicy{BaseDelay: time.Second, Multiplier: 2, Jitter: 0.5}
+
+	for i := 0; i < 100; i++ {
+		got := p.Delay(2)
+		if got < time.Second || got > 3*time.Second {
+			t.Fatalf("Delay(2) = %v, out of jitter range", got)
+		}
+	}
+}
+
+func TestRetryPolicyImmediate(t *testing.T) {
+	var p RetryPolicy
+	if got := p.Delay(3); got != 0 {
+		t.Errorf("zero policy Delay = %v, want 0", got)
+	}
+}
+
+func TestRetryPolicyOverflow(t *testing.T) {
+	p := RetryPolicy{BaseDelay: time.Second, Multiplier: 10}
+	for _, attempt := range []int{20, 400, 5000} {
+		if got := p.Delay(attempt); got <= 0 {
+			t.Errorf("Delay(%d) = %v, want positive", attempt, got)
+		}
+		if due := p.due(attempt); due <= nowMillis() {
+			t.Errorf("due(%d) = %d, want in the future", attempt, due)
+		}
+	}
+}
+
+func TestRetryPolicyJitterCapped(t *testing.T) {
+	p := RetryPolicy{BaseDelay: time.Second, Multiplier: 2, MaxDelay: 4 * time.Second, Jitter: 0.5}
+
+	for i := 0; i < 100; i++ {
+		if got := p.Delay(5); got > p.MaxDelay {
+			t.Fatalf("Delay(5) = %v, over MaxDelay", got)
+		}
+	}
+}
+
+func TestRetryPolicyDefault(t *testing.T) {
+	_, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, "")
+	EnQueueTask(q, map[string]interface{}{"n": 1}, 1, 1, "rt")
+	_, qm, _ := q.DeQueue("rt")
+
+	//默认按退避策略延迟重试，不会立即回到就绪队列
+	FailQueueTask(q, qm, "rt", nil)
+	if n, _ := rc.Llen("rt"); n != 0 {
+		t.Errorf("ready = %d, want 0", n)
+	}
+	if n, _ := rc.Zcard(delayedKey("rt")); n != 1 {
+		t.Errorf("delayed = %d, want 1", n)
+	}
+}
@@ -0,0 +1,123 @@
+package redisqueue
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/weikaishio/go-logger/logger"
+)
+
+const shutdownPollInterval = 50 * time.Millisecond //等待处理中消息的检查间隔
+
+//等待一段时间，队列退出时提前返回false
+func (q *RedisQueue) sleep(d time.Duration) bool {
+	return q.sleepContext(context.Background(), d)
+}
+
+//等待一段时间，队列退出或者ctx结束时提前返回false
+func (q *RedisQueue) sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-q.quit:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+//记录已经交给业务处理的消息
+func (q *RedisQueue) track(qm *QueueMsg) {
+	q.mu.Lock()
+	q.inflight[qm] = struct{}{}
+	q.mu.Unlock()
+}
+
+//消息已经Ack/Nack/进入死信队列
+func (q *RedisQueue) untrack(qm *QueueMsg) {
+	q.mu.Lock()
+	delete(q.inflight, qm)
+	q.mu.Unlock()
+}
+
+//正在处理的消息数量
+func (q *RedisQueue) InFlight() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.inflight)
+}
+
+//把消息原样放回队首，不计入重试次数，用于退出时还没处理完的消息
+func (q *RedisQueue) release(qm *QueueMsg) error {
+	q.untrack(qm)
+	ready := q.readyKey(qm.queue, qm.Weight)
+	moved, err := redis.Int(q.redisclient.EvalContext(msgContext(qm), nackScript, qm.processing, processingTsKey(qm.processing), ready, delayedKey(ready), qm.raw, qm.raw, 0))
+	if err != nil {
+		return err
+	}
+	if moved == 0 {
+		return ErrNotInFlight
+	}
+	return nil
+}
+
+//优雅退出：停止拉取消息，把本地缓冲的消息放回redis，等待正在处理的消息Ack/Nack，ctx到期时返回ctx.Err()
+func (q *RedisQueue) Shutdown(ctx context.Context) error {
+	q.Quit()
+
+	if err := q.drain(ctx, q.release); err != nil {
+		return err
+	}
+
+	//处理中列表已经清空，注销消费者
+	for _, name := range q.queueNames() {
+		pkey := processingKey(name, q.consumerID)
+		q.redisclient.Delete(heartbeatKey(name, q.consumerID))
+		q.redisclient.Eval(unregisterScript, consumersKey(name), pkey, processingTsKey(pkey), q.consumerID)
+	}
+
+	logger.LogInfo(fmt.Sprintf("RedisQueue %v shutdown ok", q.deQueueName))
+	return nil
+}
+
+//等待拉取消息的协程退出，用release把本地缓冲的消息放回redis，再等待正在处理的消息
+func (q *RedisQueue) drain(ctx context.Context, release func(*QueueMsg) error) error {
+	//等待拉取消息的协程退出，BRPOP最多会阻塞PullQueueBlockTime秒
+	fetched := make(chan struct{})
+	go func() {
+		q.fetchers.Wait()
+		close(fetched)
+	}()
+	select {
+	case <-fetched:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	//本地缓冲的消息放回队列
+	for drained := false; !drained; {
+		select {
+		case mst := <-q.msgque:
+			if err := release(mst.msg); err != nil {
+				logger.LogError(fmt.Sprintf("RedisQueue release error: %v, guid:%s", err, mst.msg.UUID))
+			}
+		default:
+			drained = true
+		}
+	}
+
+	//等待正在处理的消息
+	for q.InFlight() > 0 {
+		select {
+		case <-time.After(shutdownPollInterval):
+		case <-ctx.Done():
+			logger.LogWarn(fmt.Sprintf("RedisQueue %v shutdown timeout, %d messages in flight", q.deQueueName, q.InFlight()))
+			return ctx.Err()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package redisqueue
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestShutdownDrain(t *testing.T) {
+	s, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, "sd")
+	q.Start()
+
+	w := NewWorker(q, 1)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	w.Handle("sd", func(ctx context.Context, qm *QueueMsg) error {
+		close(started)
+		<-release
+		return nil
+	})
+	guid, _ := EnQueueTask(q, map[string]interface{}{"n": 1}, 1, 0, "sd")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx)
+	<-started
+
+	done := make(chan error, 1)
+	go func() {
+		sctx, scancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer scancel()
+		done <- q.Shutdown(sctx)
+	}()
+
+	//处理中的消息没有完成前不能返回
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned %v with a handler in flight", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if q.InFlight() != 1 {
+		t.Errorf("in flight = %d, want 1", q.InFlight())
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if n, ts := inProcessing(t, q, "sd"); n != 0 || ts != 0 {
+		t.Errorf("processing = %d, ts = %d, want 0", n, ts)
+	}
+	if ok, _ := s.SIsMember(consumersKey("sd"), q.consumerID); ok {
+		t.Error("consumer still registered after shutdown")
+	}
+	if dms, _ := q.DeadMsgs("sd", 0, -1); len(dms) != 0 {
+		t.Errorf("dead = %+v, want %s acked", dms, guid)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	_, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, "")
+
+	EnQueueTask(q, map[string]interface{}{"n": 1}, 1, 0, "sd")
+	_, qm, _ := q.DeQueue("sd")
+	q.track(qm)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := q.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown = %v, want context.DeadlineExceeded", err)
+	}
+	//超时后消息还在处理中列表，等待回收
+	if n, _ := inProcessing(t, q, "sd"); n != 1 {
+		t.Errorf("processing = %d, want 1", n)
+	}
+}
+
+func TestShutdownMalformedMsg(t *testing.T) {
+	s, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, "sd")
+	q.Start()
+
+	//没有消息体的消息
+	s.Lpush("sd", `{"uuid":"empty","dead_time":-1}`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, _, err := DeQueueTaskContext(ctx, q); err != ErrEmptyPayload {
+		t.Fatalf("err = %v, want ErrEmptyPayload", err)
+	}
+	if q.InFlight() != 0 {
+		t.Errorf("in flight = %d, want 0", q.InFlight())
+	}
+	if n, ts := inProcessing(t, q, "sd"); n != 0 || ts != 0 {
+		t.Errorf("processing = %d, ts = %d, want 0", n, ts)
+	}
+	dms, _ := q.DeadMsgs("sd", 0, -1)
+	if len(dms) != 1 || dms[0].Reason != DeadReasonMalformed {
+		t.Fatalf("dead = %+v", dms)
+	}
+
+	if err := q.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,627 @@
+package redisqueue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/weikaishio/go-logger/logger"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"hallversion/common/qqredis"
+)
+
+const (
+	DefaultStreamGroup  = "redisqueue" //默认消费组
+	DefaultStreamMaxLen = 100000       //流的默认最大长度（近似裁剪）
+
+	streamField      = "msg" //消息所在的字段
+	streamClaimBatch = 100   //每次XAUTOCLAIM最多转移的消息数
+)
+
+//lua里的XADD，maxlen为0时不裁剪，trim为"~"时近似裁剪
+const luaXadd = `
+local function xadd(key, maxlen, trim, msg)
+	if maxlen == '0' then
+		return redis.call('XADD', key, '*', 'msg', msg)
+	elseif trim == '~' then
+		return redis.call('XADD', key, 'MAXLEN', '~', maxlen, '*', 'msg', msg)
+	end
+	return redis.call('XADD', key, 'MAXLEN', maxlen, '*', 'msg', msg)
+end
+`
+
+//确认原消息并重新添加到流，设置了到期时间的放到延迟队列
+var streamNackScript = redis.NewScript(2, luaXadd+`
+if redis.call('XACK', KEYS[1], ARGV[1], ARGV[2]) == 0 then
+	return 0
+end
+if ARGV[4] == '0' then
+	xadd(KEYS[1], ARGV[5], ARGV[6], ARGV[3])
+else
+	redis.call('ZADD', KEYS[2], ARGV[4], ARGV[3])
+end
+return 1
+`)
+
+//确认原消息并写入死信队列，消息ID为空时直接写入
+var streamDeadScript = redis.NewScript(2, `
+if ARGV[2] ~= '' and redis.call('XACK', KEYS[1], ARGV[1], ARGV[2]) == 0 then
+	return 0
+end
+redis.call('LPUSH', KEYS[2], ARGV[3])
+return 1
+`)
+
+//把到期的消息从延迟队列移到流
+var streamPromoteScript = redis.NewScript(2, luaXadd+`
+local items = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, item in ipairs(items) do
+	redis.call('ZREM', KEYS[1], item)
+	xadd(KEYS[2], ARGV[3], ARGV[4], item)
+end
+return #items
+`)
+
+//从死信队列移回流
+var streamRequeueDeadScript = redis.NewScript(2, luaXadd+`
+if redis.call('LREM', KEYS[1], 1, ARGV[1]) == 0 then
+	return 0
+end
+xadd(KEYS[2], ARGV[3], ARGV[4], ARGV[2])
+return 1
+`)
+
+// 基于redis stream的队列，用法和RedisQueue一样，可以直接替换：
+//
+//	q := redisqueue.NewStreamQueue(rc, "order,mail", redisqueue.DefaultStreamGroup)
+//	q.Start()
+//	qm, qname, err := redisqueue.DeQueueTask(q)
+//
+// 每个队列一个流（队列名称+":stream"），消费者按消费组分摊消息，同一个消费组的消息只会投递给其中一个消费者。
+// 出列后超过WithVisibilityTimeout未确认的消息会被XAUTOCLAIM回收，重试次数减一重新入列（需要redis 6.2以上）。
+// WithRetryPolicy、WithCodec、WithDeadLetterSuffix、WithMetrics、WithTracerProvider、WithEnqueueMiddleware同样有效，
+// 优先级（WithPriorityLevels）和多队列单连接（WithPopMode）不支持。
+// 确认后的消息不会从流里删除（流可能有多个消费组），按WithStreamMaxLen裁剪。
+type StreamQueue struct {
+	base  *RedisQueue //配置和运行状态
+	group string
+}
+
+var _ Queue = (*StreamQueue)(nil)
+
+//新建基于redis stream的队列，deQueueName为消费的队列（逗号分隔），group为消费组
+func NewStreamQueue(rc qqredis.RedisCache, deQueueName, group string, opts ...QueueOption) *StreamQueue {
+	opts = append([]QueueOption{WithStreamMaxLen(DefaultStreamMaxLen, true)}, opts...)
+	return &StreamQueue{
+		base:  NewRedisQueue(rc, deQueueName, opts...),
+		group: group,
+	}
+}
+
+//流的最大长度，超过后最早的消息会被删除（包括还没消费的），maxLen为0时不裁剪
+//approx为true时按"~"近似裁剪，性能更好，只对StreamQueue有效
+func WithStreamMaxLen(maxLen int64, approx bool) QueueOption {
+	return func(q *RedisQueue) {
+		q.streamMaxLen = maxLen
+		q.streamApprox = approx
+	}
+}
+
+//队列对应的流
+func streamKey(queuename string) string {
+	return queuename + ":stream"
+}
+
+//lua脚本里XADD的裁剪参数
+func (s *StreamQueue) trimArgs() (int64, string) {
+	if s.base.streamApprox {
+		return s.base.streamMaxLen, "~"
+	}
+	return s.base.streamMaxLen, ""
+}
+
+func (s *StreamQueue) RedisCache() qqredis.RedisCache {
+	return s.base.redisclient
+}
+
+//当前消费者标识
+func (s *StreamQueue) ConsumerID() string {
+	return s.base.consumerID
+}
+
+//消费组
+func (s *StreamQueue) Group() string {
+	return s.group
+}
+
+//监控指标
+func (s *StreamQueue) Metrics() Metrics {
+	return s.base.metrics
+}
+
+func (s *StreamQueue) tracing() (trace.Tracer, propagation.TextMapPropagator) {
+	return s.base.tracing()
+}
+
+//停止拉取消息，不等待处理中的消息，需要等待的使用Shutdown
+func (s *StreamQueue) Quit() {
+	s.base.Quit()
+}
+
+//运行状态
+func (s *StreamQueue) IsRunning() bool {
+	return s.base.IsRunning()
+}
+
+//入列
+func (s *StreamQueue) EnQueue(model *QueueMsg, queuename string) error {
+	return s.EnQueueContext(context.Background(), model, queuename)
+}
+
+//入列，ctx的deadline会作为redis命令的超时时间
+func (s *StreamQueue) EnQueueContext(ctx context.Context, model *QueueMsg, queuename string) error {
+	return s.base.enqueueWith(ctx, model, queuename, s.push)
+}
+
+func (s *StreamQueue) push(ctx context.Context, model *QueueMsg, queuename string) (err error) {
+	ctx, span := startProducerSpan(ctx, s, model, queuename)
+	defer func() { qqredis.EndSpan(span, err) }()
+
+	bt, err := encodeMsg(s.base.codecFor(queuename), model)
+	if err != nil {
+		return err
+	}
+	if model.UniqueKey != "" {
+		maxLen, trim := s.trimArgs()
+		err = pushUnique(ctx, s.base.redisclient, model, queuename, streamKey(queuename), bt, "XADD", maxLen, trim)
+	} else {
+		_, err = s.base.redisclient.Xadd(ctx, streamKey(queuename), s.base.streamMaxLen, s.base.streamApprox, streamField, bt)
+	}
+	if err == nil {
+		s.base.metrics.IncEnqueued(queuename)
+	}
+	return err
+}
+
+//在指定时间入列，消息的有效期从at开始计算
+func (s *StreamQueue) EnQueueAt(model *QueueMsg, queuename string, at time.Time) error {
+	return s.base.enqueueWith(context.Background(), model, queuename, func(ctx context.Context, model *QueueMsg, queuename string) (err error) {
+		ctx, span := startProducerSpan(ctx, s, model, queuename)
+		defer func() { qqredis.EndSpan(span, err) }()
+
+		score := at.UnixNano() / int64(time.Millisecond)
+		delayDeadTime(model, score)
+
+		bt, err := encodeMsg(s.base.codecFor(queuename), model)
+		if err != nil {
+			return err
+		}
+		delayed := delayedKey(streamKey(queuename))
+		if model.UniqueKey != "" {
+			err = pushUnique(ctx, s.base.redisclient, model, queuename, delayed, bt, "ZADD", score)
+		} else {
+			_, err = s.base.redisclient.DoContext(ctx, "ZADD", delayed, score, bt)
+		}
+		if err == nil {
+			s.base.metrics.IncEnqueued(queuename)
+		}
+		return err
+	})
+}
+
+//延迟一段时间后入列
+func (s *StreamQueue) EnQueueIn(model *QueueMsg, queuename string, delay time.Duration) error {
+	return s.EnQueueAt(model, queuename, time.Now().Add(delay))
+}
+
+//返回队列，流只能追加到末尾
+func (s *StreamQueue) BackQueue(model *QueueMsg, queuename string) error {
+	return s.BackQueueContext(context.Background(), model, queuename)
+}
+
+//返回队列，ctx的deadline会作为redis命令的超时时间
+func (s *StreamQueue) BackQueueContext(ctx context.Context, model *QueueMsg, queuename string) error {
+	bt, err := encodeMsg(s.base.codecFor(queuename), model)
+	if err != nil {
+		return err
+	}
+	_, err = s.base.redisclient.Xadd(ctx, streamKey(queuename), s.base.streamMaxLen, s.base.streamApprox, streamField, bt)
+	return err
+}
+
+//按重试策略放回队列，需要延迟的放到延迟队列
+func (s *StreamQueue) backQueueRetry(ctx context.Context, model *QueueMsg, queuename string) error {
+	due := s.base.retryPolicy.due(model.Attempt)
+	if due == 0 {
+		return s.BackQueueContext(ctx, model, queuename)
+	}
+
+	bt, err := encodeMsg(s.base.codecFor(queuename), model)
+	if err != nil {
+		return err
+	}
+	_, err = s.base.redisclient.DoContext(ctx, "ZADD", delayedKey(streamKey(queuename)), due, bt)
+	return err
+}
+
+//确认消息处理完成
+func (s *StreamQueue) Ack(qm *QueueMsg) error {
+	if qm == nil || qm.streamID == "" {
+		return ErrNotDelivered
+	}
+	s.base.untrack(qm)
+	_, err := s.base.redisclient.Xack(msgContext(qm), streamKey(qm.queue), s.group, qm.streamID)
+	if err == nil {
+		releaseUnique(s.base.redisclient, qm, qm.queue)
+		s.base.metrics.IncAcked(qm.queue)
+		s.base.metrics.ObserveEndToEndLatency(qm.queue, sinceCreated(qm))
+	}
+	return err
+}
+
+//消息处理失败，确认原消息并重新入列（会带上qm当前的字段，例如Retry）
+//按重试策略和qm.Attempt计算延迟，需要延迟的放到延迟队列
+func (s *StreamQueue) Nack(qm *QueueMsg) error {
+	if qm == nil || qm.streamID == "" {
+		return ErrNotDelivered
+	}
+
+	bt, err := encodeMsg(s.base.codecFor(qm.queue), qm)
+	if err != nil {
+		return err
+	}
+
+	s.base.untrack(qm)
+
+	if err := s.requeue(msgContext(qm), qm.queue, qm.streamID, bt, s.base.retryPolicy.due(qm.Attempt)); err != nil {
+		return err
+	}
+	s.base.metrics.IncRetried(qm.queue)
+	return nil
+}
+
+//确认消息id并把bt重新入列
+func (s *StreamQueue) requeue(ctx context.Context, queuename, id string, bt []byte, due int64) error {
+	key := streamKey(queuename)
+	maxLen, trim := s.trimArgs()
+	moved, err := redis.Int(s.base.redisclient.EvalContext(ctx, streamNackScript, key, delayedKey(key), s.group, id, bt, due, maxLen, trim))
+	if err != nil {
+		return err
+	}
+	if moved == 0 {
+		return ErrNotInFlight
+	}
+	return nil
+}
+
+//把消息原样放回队列，不计入重试次数，用于退出时还没处理完的消息
+func (s *StreamQueue) release(qm *QueueMsg) error {
+	s.base.untrack(qm)
+	return s.requeue(msgContext(qm), qm.queue, qm.streamID, qm.raw, 0)
+}
+
+//死信队列名称，和RedisQueue相同
+func (s *StreamQueue) DeadQueueName(queuename string) string {
+	return s.base.DeadQueueName(queuename)
+}
+
+//消息进入死信队列
+func (s *StreamQueue) DeadLetter(qm *QueueMsg, queuename, reason string, cause error) error {
+	if qm == nil {
+		return nil
+	}
+
+	s.base.untrack(qm)
+
+	bt, err := json.Marshal(newDeadMsg(qm, queuename, reason, cause))
+	if err != nil {
+		return err
+	}
+
+	moved, err := redis.Int(s.base.redisclient.EvalContext(msgContext(qm), streamDeadScript, streamKey(queuename), s.DeadQueueName(queuename), s.group, qm.streamID, bt))
+	if err != nil {
+		return err
+	}
+	if moved == 0 {
+		return ErrNotInFlight
+	}
+	releaseUnique(s.base.redisclient, qm, queuename)
+	if reason == DeadReasonExpired {
+		s.base.metrics.IncExpired(queuename)
+	}
+	s.base.metrics.IncDeadLettered(queuename, reason)
+	return nil
+}
+
+//列出死信，start/stop同LRANGE，最新的在最前面
+func (s *StreamQueue) DeadMsgs(queuename string, start, stop int) ([]*DeadMsg, error) {
+	return s.base.DeadMsgs(queuename, start, stop)
+}
+
+//把死信重新放回原队列，retry为重新设置的重试次数
+func (s *StreamQueue) RequeueDead(queuename, guid string, retry int) error {
+	dm, err := s.base.DeadMsg(queuename, guid)
+	if err != nil {
+		return err
+	}
+	if dm.Msg == nil {
+		//损坏的死信没法放回，直接删掉
+		_, err := s.base.redisclient.DoContext(context.Background(), "LREM", s.DeadQueueName(queuename), 1, dm.raw)
+		return err
+	}
+
+	qm := dm.Msg
+	qm.Retry = retry
+	refreshDeadTime(qm)
+
+	bt, err := encodeMsg(s.base.codecFor(queuename), qm)
+	if err != nil {
+		return err
+	}
+
+	maxLen, trim := s.trimArgs()
+	moved, err := redis.Int(s.base.redisclient.Eval(streamRequeueDeadScript, s.DeadQueueName(queuename), streamKey(queuename), dm.raw, bt, maxLen, trim))
+	if err != nil {
+		return err
+	}
+	if moved == 0 {
+		return ErrDeadMsgNotFound
+	}
+	return nil
+}
+
+//消费组里已经投递但还没确认的消息，最多count条
+func (s *StreamQueue) Pending(queuename string, count int) ([]qqredis.PendingEntry, error) {
+	return s.base.redisclient.Xpending(context.Background(), streamKey(queuename), s.group, "", count)
+}
+
+//获取消息，会堵塞，队列退出后返回nil
+func (s *StreamQueue) GetQueueMsg() (*QueueMsg, string) {
+	return s.base.GetQueueMsg()
+}
+
+//获取消息，会堵塞到有消息、队列退出或者ctx结束
+func (s *StreamQueue) GetQueueMsgContext(ctx context.Context) (*QueueMsg, string, error) {
+	return s.base.GetQueueMsgContext(ctx)
+}
+
+func (s *StreamQueue) Start() {
+	q := s.base
+	if len(q.deQueueName) == 0 {
+		return
+	}
+
+	for _, name := range q.deQueueName {
+		if err := s.createGroup(name); err != nil {
+			logger.LogWarn(fmt.Sprintf("StreamQueue create group error: %v, queue:%s", err, name))
+		}
+	}
+
+	go s.runReaper()
+	go s.runPromoter()
+
+	for i := 0; i < len(q.deQueueName); i++ {
+		name := q.deQueueName[i]
+		q.fetchers.Add(1)
+		go q.fetch(func() (string, *QueueMsg, error) {
+			return s.DeQueue(name)
+		}, s.release)
+	}
+}
+
+//创建消费组，从流的开头读取，避免消费者启动前入列的消息被跳过
+func (s *StreamQueue) createGroup(queuename string) error {
+	return s.base.redisclient.Xgroupcreate(context.Background(), streamKey(queuename), s.group, "0")
+}
+
+//出列，处理完成后需要Ack
+//最多堵塞PullQueueBlockTime秒，没有消息时返回nil
+func (s *StreamQueue) DeQueue(queuename string) (string, *QueueMsg, error) {
+	return s.dequeue(context.Background(), queuename, PullQueueBlockTime*time.Second)
+}
+
+//出列，会堵塞到有消息、队列退出或者ctx结束
+func (s *StreamQueue) DeQueueContext(ctx context.Context, queuename string) (string, *QueueMsg, error) {
+	for s.IsRunning() {
+		//每次最多堵塞1秒，及时响应ctx取消
+		block := time.Second
+		if deadline, ok := ctx.Deadline(); ok {
+			if remain := time.Until(deadline); remain < block {
+				block = remain
+			}
+		}
+
+		qname, qm, err := s.dequeue(ctx, queuename, block)
+		if err != nil || qm != nil {
+			return qname, qm, err
+		}
+		if err := ctx.Err(); err != nil {
+			return "", nil, err
+		}
+	}
+	return "", nil, nil
+}
+
+func (s *StreamQueue) dequeue(ctx context.Context, queuename string, block time.Duration) (string, *QueueMsg, error) {
+	if !s.IsRunning() {
+		return "", nil, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return "", nil, err
+	}
+
+	entries, err := s.readGroup(queuename, block)
+	if err != nil && strings.HasPrefix(err.Error(), "NOGROUP") {
+		//流或者消费组被删除了，重新创建
+		if err = s.createGroup(queuename); err == nil {
+			entries, err = s.readGroup(queuename, block)
+		}
+	}
+	if err != nil {
+		logger.LogWarn(fmt.Sprintf("StreamQueue error: %v", err))
+		s.base.sleep(PullQueueErrTime * time.Second)
+		return "", nil, err
+	}
+	if len(entries) == 0 {
+		return "", nil, nil
+	}
+	return s.deliver(queuename, entries[0])
+}
+
+func (s *StreamQueue) readGroup(queuename string, block time.Duration) ([]qqredis.StreamEntry, error) {
+	//堵塞时间已经按ctx的deadline算好，这里不再用deadline作为读超时
+	return s.base.redisclient.Xreadgroup(context.Background(), s.group, s.base.consumerID, 1, block,
+		[]string{streamKey(queuename)}, []string{">"})
+}
+
+//解析读到的消息，无法解析的直接确认丢弃
+func (s *StreamQueue) deliver(queuename string, e qqredis.StreamEntry) (string, *QueueMsg, error) {
+	item := []byte(e.Fields[streamField])
+
+	model := new(QueueMsg)
+	err := decodeMsg(item, model)
+	if err != nil {
+		logger.LogError(fmt.Sprintf("StreamQueue unmarshal error: %v, id:%s, item:%s", err, e.ID, item))
+		s.base.redisclient.Xack(context.Background(), e.Stream, s.group, e.ID)
+		return "", nil, err
+	}
+
+	model.raw = item
+	model.queue = queuename
+	model.streamID = e.ID
+
+	s.base.metrics.IncDequeued(queuename)
+	return queuename, model, nil
+}
+
+//定时回收超时未确认的消息
+func (s *StreamQueue) runReaper() {
+	q := s.base
+	for q.IsRunning() {
+		for _, name := range q.deQueueName {
+			if err := s.Reap(name); err != nil {
+				logger.LogWarn(fmt.Sprintf("StreamQueue reap error: %v, queue:%s", err, name))
+			}
+		}
+		if !q.sleep(q.reapInterval) {
+			return
+		}
+	}
+}
+
+//回收一个队列里超过可见超时未确认的消息（包括已经退出的消费者的），重试次数减一重新入列，用完的进入死信队列
+func (s *StreamQueue) Reap(queuename string) error {
+	key := streamKey(queuename)
+	for start := "0-0"; ; {
+		next, entries, err := s.base.redisclient.Xautoclaim(context.Background(), key, s.group, s.base.consumerID, s.base.visibilityTimeout, start, streamClaimBatch)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			s.recoverMsg(queuename, e)
+		}
+		if next == "0-0" || next == start {
+			return nil
+		}
+		start = next
+	}
+}
+
+//把一条回收的消息重新入列，重试次数减一，重试次数用完的进入死信队列
+func (s *StreamQueue) recoverMsg(queuename string, e qqredis.StreamEntry) {
+	qm := new(QueueMsg)
+	if e.Fields == nil {
+		//消息已经被裁剪掉
+		logger.LogWarn(fmt.Sprintf("StreamQueue reap trimmed message, id:%s, queue:%s", e.ID, queuename))
+		s.base.redisclient.Xack(context.Background(), e.Stream, s.group, e.ID)
+		return
+	}
+	raw := []byte(e.Fields[streamField])
+	if err := decodeMsg(raw, qm); err != nil {
+		logger.LogError(fmt.Sprintf("StreamQueue reap unmarshal error: %v, item:%s", err, raw))
+		s.base.redisclient.Xack(context.Background(), e.Stream, s.group, e.ID)
+		return
+	}
+	qm.raw = raw
+	qm.queue = queuename
+	qm.streamID = e.ID
+
+	if qm.Retry <= 0 {
+		logger.LogError(fmt.Sprintf("消息回收失败！原因：尝试处理次数 Retry:%d，  guid:%s", qm.Retry, qm.UUID))
+		if err := s.DeadLetter(qm, queuename, DeadReasonRetryExhausted, errVisibilityTimeout); err != nil && err != ErrNotInFlight {
+			logger.LogWarn(fmt.Sprintf("StreamQueue recover error: %v, guid:%s", err, qm.UUID))
+		}
+		return
+	}
+
+	qm.Retry--
+	qm.Attempt++
+	bt, err := encodeMsg(s.base.codecFor(queuename), qm)
+	if err != nil {
+		logger.LogError(fmt.Sprintf("StreamQueue reap marshal error: %v, guid:%s", err, qm.UUID))
+		return
+	}
+	err = s.requeue(context.Background(), queuename, e.ID, bt, s.base.retryPolicy.due(qm.Attempt))
+	if err == nil {
+		s.base.metrics.IncRetried(queuename)
+		logger.LogInfo(fmt.Sprintf("guid:%s 处理超时，重新进入队列:%s", qm.UUID, queuename))
+	} else if err != ErrNotInFlight {
+		logger.LogWarn(fmt.Sprintf("StreamQueue recover error: %v, guid:%s", err, qm.UUID))
+	}
+}
+
+//把一个队列里到期的消息移到流，返回移动的数量
+func (s *StreamQueue) Promote(queuename string) (int, error) {
+	key := streamKey(queuename)
+	maxLen, trim := s.trimArgs()
+	total := 0
+	for {
+		n, err := redis.Int(s.base.redisclient.Eval(streamPromoteScript, delayedKey(key), key, nowMillis(), promoteBatch, maxLen, trim))
+		total += n
+		if err != nil || n < promoteBatch {
+			return total, err
+		}
+	}
+}
+
+//定时移动到期的消息
+func (s *StreamQueue) runPromoter() {
+	q := s.base
+	for q.IsRunning() {
+		for _, name := range q.deQueueName {
+			if _, err := s.Promote(name); err != nil {
+				logger.LogWarn(fmt.Sprintf("StreamQueue promote error: %v, queue:%s", err, name))
+			}
+		}
+		if !q.sleep(q.promoteInterval) {
+			return
+		}
+	}
+}
+
+//优雅退出：停止拉取消息，把本地缓冲的消息放回redis，等待正在处理的消息Ack/Nack，ctx到期时返回ctx.Err()
+func (s *StreamQueue) Shutdown(ctx context.Context) error {
+	q := s.base
+	q.Quit()
+
+	if err := q.drain(ctx, s.release); err != nil {
+		return err
+	}
+
+	//没有未确认的消息时从消费组删除当前消费者
+	for _, name := range q.deQueueName {
+		key := streamKey(name)
+		pending, err := q.redisclient.Xpending(context.Background(), key, s.group, q.consumerID, 1)
+		if err != nil || len(pending) > 0 {
+			continue
+		}
+		q.redisclient.Xgroupdelconsumer(context.Background(), key, s.group, q.consumerID)
+	}
+
+	logger.LogInfo(fmt.Sprintf("StreamQueue %v shutdown ok", q.deQueueName))
+	return nil
+}
@@ -0,0 +1,188 @@
+package redisqueue
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStreamEnqueueAck(t *testing.T) {
+	_, rc := newTestRedis(t)
+	q := NewStreamQueue(rc, "sq", DefaultStreamGroup)
+
+	guid, err := EnQueueTask(q, map[string]interface{}{"n": 1}, 1, 1, "sq", WithHeader("trace", "t1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	qname, qm, err := q.DeQueue("sq")
+	if err != nil || qm == nil {
+		t.Fatal(qm, err)
+	}
+	if qname != "sq" || qm.UUID != guid || qm.Header("trace") != "t1" {
+		t.Errorf("got queue %q msg %+v", qname, qm)
+	}
+	if p, _ := q.Pending("sq", 10); len(p) != 1 {
+		t.Errorf("pending = %d, want 1", len(p))
+	}
+
+	if err := q.Ack(qm); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := q.Pending("sq", 10); len(p) != 0 {
+		t.Errorf("pending after ack = %d, want 0", len(p))
+	}
+	if err := q.Ack(&QueueMsg{}); err != ErrNotDelivered {
+		t.Errorf("ack undelivered err = %v, want ErrNotDelivered", err)
+	}
+}
+
+func TestStreamDequeueShortBlock(t *testing.T) {
+	_, rc := newTestRedis(t)
+	q := NewStreamQueue(rc, "sq", DefaultStreamGroup)
+
+	//不足1毫秒的堵塞时间不能变成BLOCK 0（一直堵塞）
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, qm, err := q.dequeue(context.Background(), "sq", 500*time.Microsecond); err != nil || qm != nil {
+			t.Errorf("dequeue = %v, %v", qm, err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("dequeue with sub-millisecond block did not return")
+	}
+}
+
+func TestStreamNackDelay(t *testing.T) {
+	s, rc := newTestRedis(t)
+	q := NewStreamQueue(rc, "sq", DefaultStreamGroup, WithRetryPolicy(RetryPolicy{BaseDelay: time.Minute}))
+
+	if _, err := EnQueueTask(q, map[string]interface{}{"n": 1}, 1, 1, "sq"); err != nil {
+		t.Fatal(err)
+	}
+	_, qm, _ := q.DeQueue("sq")
+	FailQueueTask(q, qm, "sq", errors.New("boom"))
+
+	if p, _ := q.Pending("sq", 10); len(p) != 0 {
+		t.Errorf("pending after nack = %d, want 0", len(p))
+	}
+	delayed, err := s.ZMembers(delayedKey(streamKey("sq")))
+	if err != nil || len(delayed) != 1 {
+		t.Fatalf("delayed = %v, %v", delayed, err)
+	}
+	//还没到期
+	if n, err := q.Promote("sq"); n != 0 || err != nil {
+		t.Errorf("promote = %d, %v, want 0", n, err)
+	}
+
+	s.ZAdd(delayedKey(streamKey("sq")), 0, delayed[0])
+	if n, err := q.Promote("sq"); n != 1 || err != nil {
+		t.Fatalf("promote = %d, %v, want 1", n, err)
+	}
+	_, qm2, _ := q.DeQueue("sq")
+	if qm2 == nil || qm2.UUID != qm.UUID || qm2.Attempt != 1 || qm2.Retry != 0 {
+		t.Errorf("redelivered %+v", qm2)
+	}
+}
+
+func TestStreamReap(t *testing.T) {
+	_, rc := newTestRedis(t)
+	q := NewStreamQueue(rc, "sq", DefaultStreamGroup, WithVisibilityTimeout(time.Millisecond), WithRetryPolicy(RetryPolicy{}))
+
+	guid, _ := EnQueueTask(q, map[string]interface{}{"n": 1}, 1, 1, "sq")
+	_, qm, _ := q.DeQueue("sq")
+	time.Sleep(5 * time.Millisecond)
+	if err := q.Reap("sq"); err != nil {
+		t.Fatal(err)
+	}
+	//回收后原消息已经确认，迟到的Ack不报错
+	if err := q.Ack(qm); err != nil {
+		t.Errorf("late ack err = %v", err)
+	}
+
+	_, qm, _ = q.DeQueue("sq")
+	if qm == nil || qm.UUID != guid || qm.Attempt != 1 || qm.Retry != 0 {
+		t.Fatalf("reaped msg %+v", qm)
+	}
+
+	//重试次数用完，再次超时进入死信队列
+	time.Sleep(5 * time.Millisecond)
+	if err := q.Reap("sq"); err != nil {
+		t.Fatal(err)
+	}
+	dms, _ := q.DeadMsgs("sq", 0, -1)
+	if len(dms) != 1 || dms[0].Reason != DeadReasonRetryExhausted || dms[0].LastError != errVisibilityTimeout.Error() {
+		t.Fatalf("dead = %+v", dms)
+	}
+	if p, _ := q.Pending("sq", 10); len(p) != 0 {
+		t.Errorf("pending after reap = %d, want 0", len(p))
+	}
+}
+
+func TestStreamDeadRequeue(t *testing.T) {
+	_, rc := newTestRedis(t)
+	q := NewStreamQueue(rc, "sq", DefaultStreamGroup)
+
+	guid, _ := EnQueueTask(q, map[string]interface{}{"n": 1}, 1, 0, "sq")
+	_, qm, _ := q.DeQueue("sq")
+	FailQueueTask(q, qm, "sq", errors.New("boom"))
+
+	dms, _ := q.DeadMsgs("sq", 0, -1)
+	if len(dms) != 1 || dms[0].Msg.UUID != guid || dms[0].LastError != "boom" {
+		t.Fatalf("dead = %+v", dms)
+	}
+	if err := q.DeadLetter(qm, "sq", DeadReasonRetryExhausted, nil); err != ErrNotInFlight {
+		t.Errorf("dead letter twice err = %v, want ErrNotInFlight", err)
+	}
+
+	if err := q.RequeueDead("sq", guid, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.RequeueDead("sq", guid, 2); err != ErrDeadMsgNotFound {
+		t.Errorf("requeue twice err = %v, want ErrDeadMsgNotFound", err)
+	}
+	_, qm, _ = q.DeQueue("sq")
+	if qm == nil || qm.UUID != guid || qm.Retry != 2 {
+		t.Errorf("requeued %+v", qm)
+	}
+}
+
+func TestStreamMaxLen(t *testing.T) {
+	_, rc := newTestRedis(t)
+	q := NewStreamQueue(rc, "sq", DefaultStreamGroup, WithStreamMaxLen(3, false))
+
+	for i := 0; i < 10; i++ {
+		if _, err := EnQueueTask(q, map[string]interface{}{"n": i}, 1, 0, "sq"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := rc.Xlen(context.Background(), streamKey("sq")); n != 3 || err != nil {
+		t.Errorf("xlen = %d, %v, want 3", n, err)
+	}
+	//裁剪掉的是最早的消息
+	_, qm, _ := q.DeQueue("sq")
+	if qm == nil || qm.Msg["n"] != float64(7) {
+		t.Errorf("first msg %+v", qm)
+	}
+}
+
+func TestAdminSkipsStreamKeys(t *testing.T) {
+	_, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, "")
+	sq := NewStreamQueue(rc, "sq", DefaultStreamGroup)
+
+	EnQueueTask(q, map[string]interface{}{"n": 1}, 1, 0, "lq")
+	EnQueueTask(sq, map[string]interface{}{"n": 1}, 1, 0, "sq")
+	sq.EnQueueIn(&QueueMsg{UUID: "d", Msg: map[string]interface{}{"n": 2}}, "sq", time.Minute)
+
+	stats, err := NewAdmin(q).QueueStats("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 || stats[0].Name != "lq" || stats[0].Ready != 1 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
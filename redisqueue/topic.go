@@ -0,0 +1,246 @@
+package redisqueue
+
+import (
+	"context"
+	"errors"
+
+	"github.com/garyburd/redigo/redis"
+	"hallversion/common/qqredis"
+)
+
+var (
+	ErrTopicUniqueKey = errors.New("redisqueue: unique key is not supported by topics")
+	ErrTopicChanged   = errors.New("redisqueue: topic subscribers kept changing while publishing")
+)
+
+//发布时订阅队列被修改后重试的次数
+const publishRetries = 3
+
+//KEYS[1]为订阅队列集合，KEYS[2..]为订阅队列的key，ARGV的前#KEYS-1个为订阅队列名称
+//订阅队列和读取时不一致时返回false，消息不写入
+const luaSubscribed = `
+local function subscribed()
+	local n = #KEYS - 1
+	if redis.call('SCARD', KEYS[1]) ~= n then
+		return false
+	end
+	for i = 1, n do
+		if redis.call('SISMEMBER', KEYS[1], ARGV[i]) == 0 then
+			return false
+		end
+	end
+	return true
+end
+`
+
+//把消息复制到每个订阅队列，订阅队列发生变化时返回-1
+var publishScript = redis.NewScript(-1, luaSubscribed+`
+if not subscribed() then
+	return -1
+end
+local n = #KEYS - 1
+for i = 2, #KEYS do
+	redis.call('LPUSH', KEYS[i], ARGV[n + 1])
+end
+return n
+`)
+
+//把消息复制到每个订阅队列对应的流，订阅队列发生变化时返回-1
+var streamPublishScript = redis.NewScript(-1, luaXadd+luaSubscribed+`
+if not subscribed() then
+	return -1
+end
+local n = #KEYS - 1
+for i = 2, #KEYS do
+	xadd(KEYS[i], ARGV[n + 2], ARGV[n + 3], ARGV[n + 1])
+end
+return n
+`)
+
+// 支持主题的队列，RedisQueue和StreamQueue都实现了
+// 一条消息发布到主题后，每个订阅队列都会收到一份（UUID相同），各自消费、重试和进入死信队列，互不影响
+// 和RedisCache.Publish不同，没有消费者在线时消息会留在订阅队列里
+// 同一个主题的发布者和订阅者需要使用相同类型的队列
+// 主题不支持唯一键（返回ErrTopicUniqueKey），也不区分优先级：消息都进入订阅队列的最低优先级，
+// 订阅者不管WithPriorityLevels怎么设置都能收到
+// 发布时订阅队列被修改会重新读取后再发布，一直在变化时返回ErrTopicChanged
+type Publisher interface {
+	Subscribe(topic, queuename string) error
+	Unsubscribe(topic, queuename string) error
+	Subscribers(topic string) ([]string, error)
+	Publish(topic string, model *QueueMsg) (int, error)
+	PublishContext(ctx context.Context, topic string, model *QueueMsg) (int, error)
+}
+
+/**
+	topic:主题
+	msg:消息体
+	weight:消息权重
+	retry:消息重试次数
+	opts:消息的配置项，不能使用唯一键（WithUniqueKey）
+**/
+func PublishTask(p Publisher, topic string, msg map[string]interface{}, weight, retry int, opts ...MsgOption) (string, error) {
+	m, err := NewQueueMsg(msg, weight, retry, opts...)
+	if err != nil {
+		return "", err
+	}
+	_, err = p.Publish(topic, m)
+	return m.UUID, err
+}
+
+//主题的订阅队列集合
+func subscribersKey(topic string) string {
+	return topic + ":subscribers"
+}
+
+//订阅主题，之后发布的消息会复制一份到queuename
+func subscribe(rc qqredis.RedisCache, topic, queuename string) error {
+	_, err := rc.DoContext(context.Background(), "SADD", subscribersKey(topic), queuename)
+	return err
+}
+
+//取消订阅，queuename里已经收到的消息不受影响
+func unsubscribe(rc qqredis.RedisCache, topic, queuename string) error {
+	_, err := rc.DoContext(context.Background(), "SREM", subscribersKey(topic), queuename)
+	return err
+}
+
+//主题的订阅队列
+func subscribers(rc qqredis.RedisCache, topic string) ([]string, error) {
+	return redis.Strings(rc.DoContext(context.Background(), "SMEMBERS", subscribersKey(topic)))
+}
+
+//读取订阅队列后把消息写入每个订阅队列的key（keyOf），脚本里访问的key都通过KEYS传入
+//脚本里确认订阅队列没有变化后才写入，发布和订阅、取消订阅同时进行时，消息要么发给订阅前的全部队列，要么发给订阅后的
+//订阅队列一直在变化时重试publishRetries次后返回ErrTopicChanged
+//返回收到消息的订阅队列，没有订阅队列时不执行脚本
+func publish(ctx context.Context, rc qqredis.RedisCache, topic string, model *QueueMsg, script *redis.Script, keyOf func(string) string, args ...interface{}) ([]string, error) {
+	if model.UniqueKey != "" {
+		return nil, ErrTopicUniqueKey
+	}
+
+	for i := 0; i <= publishRetries; i++ {
+		queues, err := redis.Strings(rc.DoContext(ctx, "SMEMBERS", subscribersKey(topic)))
+		if err != nil || len(queues) == 0 {
+			return nil, err
+		}
+		ok, err := publishTo(ctx, rc, topic, queues, script, keyOf, args...)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return queues, nil
+		}
+	}
+	return nil, ErrTopicChanged
+}
+
+//把消息写入queues，queues和主题当前的订阅队列不一致时不写入，返回false
+func publishTo(ctx context.Context, rc qqredis.RedisCache, topic string, queues []string, script *redis.Script, keyOf func(string) string, args ...interface{}) (bool, error) {
+	keysAndArgs := make([]interface{}, 0, 2*len(queues)+len(args)+2)
+	keysAndArgs = append(keysAndArgs, len(queues)+1, subscribersKey(topic))
+	for _, name := range queues {
+		keysAndArgs = append(keysAndArgs, keyOf(name))
+	}
+	for _, name := range queues {
+		keysAndArgs = append(keysAndArgs, name)
+	}
+	keysAndArgs = append(keysAndArgs, args...)
+	n, err := redis.Int(rc.EvalContext(ctx, script, keysAndArgs...))
+	if err != nil {
+		return false, err
+	}
+	return n >= 0, nil
+}
+
+//订阅主题，之后发布的消息会复制一份到queuename
+func (q *RedisQueue) Subscribe(topic, queuename string) error {
+	return subscribe(q.redisclient, topic, queuename)
+}
+
+//取消订阅，queuename里已经收到的消息不受影响
+func (q *RedisQueue) Unsubscribe(topic, queuename string) error {
+	return unsubscribe(q.redisclient, topic, queuename)
+}
+
+//主题的订阅队列
+func (q *RedisQueue) Subscribers(topic string) ([]string, error) {
+	return subscribers(q.redisclient, topic)
+}
+
+//发布消息到主题，返回收到消息的订阅队列数量，没有订阅队列时消息被丢弃
+func (q *RedisQueue) Publish(topic string, model *QueueMsg) (int, error) {
+	return q.PublishContext(context.Background(), topic, model)
+}
+
+//发布消息到主题，ctx的deadline会作为redis命令的超时时间
+//生产者中间件同样有效，queuename为主题
+func (q *RedisQueue) PublishContext(ctx context.Context, topic string, model *QueueMsg) (int, error) {
+	var n int
+	err := q.enqueueWith(ctx, model, topic, func(ctx context.Context, model *QueueMsg, topic string) (err error) {
+		ctx, span := startProducerSpan(ctx, q, model, topic)
+		defer func() { qqredis.EndSpan(span, err) }()
+
+		bt, err := encodeMsg(q.codecFor(topic), model)
+		if err != nil {
+			return err
+		}
+		//订阅者的优先级设置可能和发布者不同，统一进入最低优先级（就是队列名本身）
+		queues, err := publish(ctx, q.redisclient, topic, model, publishScript, func(name string) string { return name }, bt)
+		if err != nil {
+			return err
+		}
+		for _, name := range queues {
+			q.metrics.IncEnqueued(name)
+		}
+		n = len(queues)
+		return nil
+	})
+	return n, err
+}
+
+//订阅主题，之后发布的消息会复制一份到queuename
+func (s *StreamQueue) Subscribe(topic, queuename string) error {
+	return subscribe(s.base.redisclient, topic, queuename)
+}
+
+//取消订阅，queuename里已经收到的消息不受影响
+func (s *StreamQueue) Unsubscribe(topic, queuename string) error {
+	return unsubscribe(s.base.redisclient, topic, queuename)
+}
+
+//主题的订阅队列
+func (s *StreamQueue) Subscribers(topic string) ([]string, error) {
+	return subscribers(s.base.redisclient, topic)
+}
+
+//发布消息到主题，返回收到消息的订阅队列数量，没有订阅队列时消息被丢弃
+func (s *StreamQueue) Publish(topic string, model *QueueMsg) (int, error) {
+	return s.PublishContext(context.Background(), topic, model)
+}
+
+//发布消息到主题，ctx的deadline会作为redis命令的超时时间
+//生产者中间件同样有效，queuename为主题
+func (s *StreamQueue) PublishContext(ctx context.Context, topic string, model *QueueMsg) (int, error) {
+	var n int
+	err := s.base.enqueueWith(ctx, model, topic, func(ctx context.Context, model *QueueMsg, topic string) (err error) {
+		ctx, span := startProducerSpan(ctx, s, model, topic)
+		defer func() { qqredis.EndSpan(span, err) }()
+
+		bt, err := encodeMsg(s.base.codecFor(topic), model)
+		if err != nil {
+			return err
+		}
+		maxLen, trim := s.trimArgs()
+		queues, err := publish(ctx, s.base.redisclient, topic, model, streamPublishScript, streamKey, bt, maxLen, trim)
+		if err != nil {
+			return err
+		}
+		for _, name := range queues {
+			s.base.metrics.IncEnqueued(name)
+		}
+		n = len(queues)
+		return nil
+	})
+	return n, err
+}
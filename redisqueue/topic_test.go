@@ -0,0 +1,136 @@
+package redisqueue
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTopicFanOut(t *testing.T) {
+	_, rc := newTestRedis(t)
+	pub := NewRedisQueue(rc, "", WithPriorityLevels(3))
+	//订阅者的优先级设置和发布者不同
+	sub := NewRedisQueue(rc, "a,b,c")
+
+	for _, name := range []string{"a", "b", "c", "c"} {
+		if err := pub.Subscribe("orders", name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if subs, _ := pub.Subscribers("orders"); len(subs) != 3 {
+		t.Errorf("subscribers = %v, want 3", subs)
+	}
+
+	guid, err := PublishTask(pub, "orders", map[string]interface{}{"n": 1}, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		_, qm, err := sub.DeQueue(name)
+		if err != nil || qm == nil {
+			t.Fatalf("%s: %v, %v", name, qm, err)
+		}
+		if qm.UUID != guid || qm.Weight != 2 {
+			t.Errorf("%s: got %+v", name, qm)
+		}
+		sub.Ack(qm)
+	}
+}
+
+func TestTopicNoSubscribers(t *testing.T) {
+	s, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, "")
+
+	n, err := q.Publish("orders", &QueueMsg{UUID: "u", Msg: map[string]interface{}{"n": 1}})
+	if n != 0 || err != nil {
+		t.Errorf("publish = %d, %v, want 0", n, err)
+	}
+	if keys := s.Keys(); len(keys) != 0 {
+		t.Errorf("keys = %v, want none", keys)
+	}
+}
+
+func TestTopicUnsubscribe(t *testing.T) {
+	s, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, "")
+	q.Subscribe("orders", "a")
+	q.Subscribe("orders", "b")
+
+	if _, err := PublishTask(q, "orders", map[string]interface{}{"n": 1}, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Unsubscribe("orders", "a"); err != nil {
+		t.Fatal(err)
+	}
+	n, err := q.Publish("orders", &QueueMsg{UUID: "u", Msg: map[string]interface{}{"n": 2}})
+	if n != 1 || err != nil {
+		t.Errorf("publish = %d, %v, want 1", n, err)
+	}
+	//已经收到的消息不受影响
+	if items, _ := s.List("a"); len(items) != 1 {
+		t.Errorf("a length = %d, want 1", len(items))
+	}
+	if items, _ := s.List("b"); len(items) != 2 {
+		t.Errorf("b length = %d, want 2", len(items))
+	}
+}
+
+func TestTopicPublishStale(t *testing.T) {
+	s, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, "")
+	q.Subscribe("orders", "a")
+	q.Subscribe("orders", "b")
+	keyOf := func(name string) string { return name }
+
+	//读取订阅队列之后有订阅或者取消订阅时不写入
+	for _, queues := range [][]string{{"a"}, {"a", "c"}, {"a", "b", "c"}} {
+		ok, err := publishTo(context.Background(), rc, "orders", queues, publishScript, keyOf, "m")
+		if ok || err != nil {
+			t.Errorf("publishTo(%v) = %v, %v, want false", queues, ok, err)
+		}
+	}
+	if keys := s.Keys(); len(keys) != 1 {
+		t.Errorf("keys = %v, want only the subscribers", keys)
+	}
+	if ok, err := publishTo(context.Background(), rc, "orders", []string{"b", "a"}, publishScript, keyOf, "m"); !ok || err != nil {
+		t.Errorf("publishTo = %v, %v, want true", ok, err)
+	}
+	for _, name := range []string{"a", "b"} {
+		if items, _ := s.List(name); len(items) != 1 || items[0] != "m" {
+			t.Errorf("%s = %v, want [m]", name, items)
+		}
+	}
+}
+
+func TestTopicUniqueKey(t *testing.T) {
+	_, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, "")
+	q.Subscribe("orders", "a")
+
+	_, err := PublishTask(q, "orders", map[string]interface{}{"n": 1}, 0, 0, WithUniqueKey("k", time.Minute))
+	if err != ErrTopicUniqueKey {
+		t.Errorf("err = %v, want ErrTopicUniqueKey", err)
+	}
+}
+
+func TestStreamTopicFanOut(t *testing.T) {
+	_, rc := newTestRedis(t)
+	q := NewStreamQueue(rc, "a,b", DefaultStreamGroup)
+	q.Subscribe("orders", "a")
+	q.Subscribe("orders", "b")
+
+	var p Publisher = q
+	guid, err := PublishTask(p, "orders", map[string]interface{}{"n": 1}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b"} {
+		_, qm, err := q.DeQueue(name)
+		if err != nil || qm == nil || qm.UUID != guid {
+			t.Fatalf("%s: %v, %v", name, qm, err)
+		}
+		if err := q.Ack(qm); err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package redisqueue
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "hallversion/common/redisqueue"
+
+//链路追踪，默认使用otel的全局TracerProvider
+func WithTracerProvider(tp trace.TracerProvider) QueueOption {
+	return func(q *RedisQueue) {
+		q.tracerProvider = tp
+	}
+}
+
+//链路上下文的传播方式，默认使用otel的全局TextMapPropagator（一般为W3C trace context）
+func WithPropagator(p propagation.TextMapPropagator) QueueOption {
+	return func(q *RedisQueue) {
+		q.propagator = p
+	}
+}
+
+func (q *RedisQueue) tracing() (trace.Tracer, propagation.TextMapPropagator) {
+	tp, p := q.tracerProvider, q.propagator
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	if p == nil {
+		p = otel.GetTextMapPropagator()
+	}
+	return tp.Tracer(tracerName), p
+}
+
+//Queue的链路追踪，不是RedisQueue的使用otel的全局配置
+func tracingOf(q Queue) (trace.Tracer, propagation.TextMapPropagator) {
+	if t, ok := q.(interface {
+		tracing() (trace.Tracer, propagation.TextMapPropagator)
+	}); ok {
+		return t.tracing()
+	}
+	return otel.GetTracerProvider().Tracer(tracerName), otel.GetTextMapPropagator()
+}
+
+func msgAttributes(qm *QueueMsg, queuename string) trace.SpanStartOption {
+	return trace.WithAttributes(
+		attribute.String("messaging.system", "redis"),
+		attribute.String("messaging.destination.name", queuename),
+		attribute.String("messaging.message.id", qm.UUID),
+	)
+}
+
+//入列时开始producer span，并把链路上下文写入消息的Headers
+func startProducerSpan(ctx context.Context, q Queue, qm *QueueMsg, queuename string) (context.Context, trace.Span) {
+	tracer, propagator := tracingOf(q)
+	ctx, span := tracer.Start(ctx, queuename+" publish", trace.WithSpanKind(trace.SpanKindProducer), msgAttributes(qm, queuename))
+
+	propagator.Inject(ctx, headerCarrier{qm})
+	return ctx, span
+}
+
+//开始consumer span，Worker会自动调用，父span为ctx里的span，入列时的链路上下文（消息的Headers）作为link
+//之后Ack/Nack等操作的redis命令会作为这个span的子span
+//自己用DeQueueTask消费的，处理完成后需要调用span.End()
+func StartConsumerSpan(ctx context.Context, q Queue, qm *QueueMsg, queuename string) (context.Context, trace.Span) {
+	tracer, propagator := tracingOf(q)
+
+	opts := []trace.SpanStartOption{trace.WithSpanKind(trace.SpanKindConsumer), msgAttributes(qm, queuename)}
+	pctx := propagator.Extract(context.Background(), headerCarrier{qm})
+	if sc := trace.SpanContextFromContext(pctx); sc.IsValid() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: sc}))
+	}
+	ctx, span := tracer.Start(ctx, queuename+" process", opts...)
+	qm.spanContext = span.SpanContext()
+	return ctx, span
+}
+
+//消息的redis命令使用的ctx，带上consumer span
+func msgContext(qm *QueueMsg) context.Context {
+	return trace.ContextWithSpanContext(context.Background(), qm.spanContext)
+}
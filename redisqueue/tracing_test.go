@@ -0,0 +1,76 @@
+package redisqueue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracing(t *testing.T) {
+	_, rc := newTestRedis(t)
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	rc = rc.WithTracerProvider(tp)
+	q := NewRedisQueue(rc, "tq", WithTracerProvider(tp), WithPropagator(propagation.TraceContext{}))
+	q.Start()
+
+	ctx, producer := tp.Tracer("test").Start(context.Background(), "http")
+	qm, _ := NewQueueMsg(map[string]interface{}{"n": 1}, 1, 1)
+	if err := q.EnQueueContext(ctx, qm, "tq"); err != nil {
+		t.Fatal(err)
+	}
+	producer.End()
+	if qm.Header("traceparent") == "" {
+		t.Fatalf("headers = %v", qm.Headers)
+	}
+
+	//worker的ctx里的span是consumer span的父span
+	wctx, worker := tp.Tracer("test").Start(context.Background(), "worker")
+	wctx, cancel := context.WithTimeout(wctx, 500*time.Millisecond)
+	defer cancel()
+	w := NewWorker(q, 1)
+	var got trace.SpanContext
+	w.Handle("tq", func(ctx context.Context, qm *QueueMsg) error {
+		got = trace.SpanContextFromContext(ctx)
+		return nil
+	})
+	w.Run(wctx)
+	worker.End()
+
+	if got.TraceID() != worker.SpanContext().TraceID() {
+		t.Error("consumer span is not a child of the worker span")
+	}
+
+	var process sdktrace.ReadOnlySpan
+	spans := exp.GetSpans().Snapshots()
+	for _, sp := range spans {
+		if sp.Name() == "tq process" {
+			process = sp
+		}
+	}
+	if process == nil {
+		t.Fatal("no process span")
+	}
+	if process.Parent().SpanID() != worker.SpanContext().SpanID() {
+		t.Errorf("process parent = %v", process.Parent().SpanID())
+	}
+	if links := process.Links(); len(links) != 1 || links[0].SpanContext.TraceID() != producer.SpanContext().TraceID() {
+		t.Errorf("process links = %v", links)
+	}
+
+	//Ack的redis命令挂在consumer span下面
+	acked := false
+	for _, sp := range spans {
+		if sp.Name() == "EVALSHA" && sp.Parent().SpanID() == process.SpanContext().SpanID() {
+			acked = true
+		}
+	}
+	if !acked {
+		t.Error("ack command is not traced under the process span")
+	}
+}
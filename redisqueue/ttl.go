@@ -0,0 +1,40 @@
+package redisqueue
+
+import "time"
+
+//新消息默认的有效期，可以用WithTTL/WithNoExpire按消息设置
+var DefaultMsgTTL = MsgTimeOut * time.Second
+
+//旧版本的消息时间以秒保存，小于这个值的时间按秒处理（1e11毫秒约为1973年，1e11秒约为5138年）
+const legacySecondsLimit = 1e11
+
+//消息有效期，从创建时间开始计算，ttl<=0时永不过期
+func WithTTL(ttl time.Duration) MsgOption {
+	return func(qm *QueueMsg) {
+		if ttl <= 0 {
+			qm.DeadTime = -1
+			return
+		}
+		qm.DeadTime = qm.Createdtime + int64(ttl/time.Millisecond)
+	}
+}
+
+//消息永不过期
+func WithNoExpire() MsgOption {
+	return WithTTL(0)
+}
+
+//消息是否已经过期
+func (qm *QueueMsg) Expired() bool {
+	return qm.DeadTime > 0 && nowMillis() > qm.DeadTime
+}
+
+//旧版本写入的消息时间是秒，统一转换成毫秒
+func normalizeMsgTime(qm *QueueMsg) {
+	if qm.Createdtime > 0 && qm.Createdtime < legacySecondsLimit {
+		qm.Createdtime *= 1000
+	}
+	if qm.DeadTime > 0 && qm.DeadTime < legacySecondsLimit {
+		qm.DeadTime *= 1000
+	}
+}
@@ -0,0 +1,52 @@
+package redisqueue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewQueueMsgTTL(t *testing.T) {
+	qm, _ := NewQueueMsg(nil, 1, 0)
+	if qm.DeadTime-qm.Createdtime != int64(DefaultMsgTTL/time.Millisecond) {
+		t.Errorf("default ttl = %dms, want %v", qm.DeadTime-qm.Createdtime, DefaultMsgTTL)
+	}
+	if qm.Createdtime < legacySecondsLimit {
+		t.Errorf("create time %d is not in milliseconds", qm.Createdtime)
+	}
+
+	qm, _ = NewQueueMsg(nil, 1, 0, WithTTL(1500*time.Millisecond))
+	if qm.DeadTime-qm.Createdtime != 1500 {
+		t.Errorf("ttl = %dms, want 1500ms", qm.DeadTime-qm.Createdtime)
+	}
+
+	qm, _ = NewQueueMsg(nil, 1, 0, WithNoExpire())
+	if qm.DeadTime >= 0 || qm.Expired() {
+		t.Errorf("dead time = %d, want never expire", qm.DeadTime)
+	}
+
+	qm, _ = NewQueueMsg(nil, 1, 0, WithTTL(time.Millisecond))
+	qm.DeadTime -= 10
+	if !qm.Expired() {
+		t.Errorf("message should be expired")
+	}
+}
+
+func TestDecodeLegacySeconds(t *testing.T) {
+	qm := new(QueueMsg)
+	data := []byte(`{"uuid":"u1","msg":{"cmd":"x"},"create_time":1540000000,"dead_time":1540006000,"weight":1,"retry":1}`)
+	if err := decodeMsg(data, qm); err != nil {
+		t.Fatal(err)
+	}
+	if qm.Createdtime != 1540000000000 || qm.DeadTime != 1540006000000 {
+		t.Errorf("got create_time %d, dead_time %d", qm.Createdtime, qm.DeadTime)
+	}
+
+	qm = new(QueueMsg)
+	data = []byte(`{"uuid":"u2","create_time":1540000000,"dead_time":-1}`)
+	if err := decodeMsg(data, qm); err != nil {
+		t.Fatal(err)
+	}
+	if qm.DeadTime != -1 {
+		t.Errorf("never expire dead_time = %d, want -1", qm.DeadTime)
+	}
+}
@@ -0,0 +1,176 @@
+package redisqueue
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/weikaishio/go-logger/logger"
+)
+
+const DeadReasonDecodeFailed = "decode_failed" //消息体无法解析
+
+var ErrEmptyPayload = errors.New("redisqueue: message has no payload")
+
+// 带类型消息体的消息
+type TypedMsg[T any] struct {
+	*QueueMsg
+	Payload T
+}
+
+//新建带类型消息体的队列任务，消息体以json保存在Body中
+func NewTypedQueueMsg[T any](payload T, weight, retry int, opts ...MsgOption) (*QueueMsg, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	qm, err := NewQueueMsg(nil, weight, retry, opts...)
+	if err != nil {
+		return nil, err
+	}
+	qm.Body = body
+	return qm, nil
+}
+
+//解析消息体，兼容只有Msg的旧消息
+//忽略T没有的字段，生产者新增字段后旧的消费者照常处理
+func DecodePayload[T any](qm *QueueMsg) (T, error) {
+	return decodePayload[T](qm, false)
+}
+
+//strict为true时消息体里有T没有的字段返回错误
+func decodePayload[T any](qm *QueueMsg, strict bool) (T, error) {
+	var payload T
+	if qm == nil {
+		return payload, ErrEmptyPayload
+	}
+
+	body := []byte(qm.Body)
+	if len(body) == 0 {
+		if qm.Msg == nil {
+			return payload, ErrEmptyPayload
+		}
+		var err error
+		if body, err = json.Marshal(qm.Msg); err != nil {
+			return payload, err
+		}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	err := dec.Decode(&payload)
+	return payload, err
+}
+
+//带类型消息体入列
+func EnQueueTyped[T any](q Queue, payload T, weight, retry int, queuename string, opts ...MsgOption) (string, error) {
+	return EnQueueTypedContext(context.Background(), q, payload, weight, retry, queuename, opts...)
+}
+
+//带类型消息体入列，ctx的deadline会作为redis命令的超时时间
+func EnQueueTypedContext[T any](ctx context.Context, q Queue, payload T, weight, retry int, queuename string, opts ...MsgOption) (string, error) {
+	m, err := NewTypedQueueMsg(payload, weight, retry, opts...)
+	if err != nil {
+		return "", err
+	}
+	err = q.EnQueueContext(ctx, m, queuename)
+	return m.UUID, err
+}
+
+// 消息体类型固定的队列，绑定一个队列名称，只读写这个队列
+// 出列直接从queuename读取，不经过Start启动的拉取，queuename不要同时交给GetQueueMsg或者Worker消费
+type TypedQueue[T any] struct {
+	q      Queue
+	name   string
+	strict bool
+}
+
+// TypedQueue的配置项
+type TypedOption func(*typedConfig)
+
+type typedConfig struct {
+	strict bool
+}
+
+//出列时消息体里有T没有的字段按解析失败处理（进入死信队列），默认忽略多出的字段
+//用于避免把其他类型的消息解析成零值，生产者新增字段前需要先升级消费者
+func WithStrictDecode() TypedOption {
+	return func(c *typedConfig) {
+		c.strict = true
+	}
+}
+
+func NewTypedQueue[T any](q Queue, queuename string, opts ...TypedOption) *TypedQueue[T] {
+	var c typedConfig
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return &TypedQueue[T]{q: q, name: queuename, strict: c.strict}
+}
+
+//底层的队列，用于Ack/Nack等操作
+func (t *TypedQueue[T]) Queue() Queue {
+	return t.q
+}
+
+//绑定的队列名称
+func (t *TypedQueue[T]) Name() string {
+	return t.name
+}
+
+/**
+	payload:消息体
+	weight:消息权重
+	retry:消息重试次数
+	opts:消息的配置项
+**/
+func (t *TypedQueue[T]) EnQueue(payload T, weight, retry int, opts ...MsgOption) (string, error) {
+	return EnQueueTyped(t.q, payload, weight, retry, t.name, opts...)
+}
+
+func (t *TypedQueue[T]) EnQueueContext(ctx context.Context, payload T, weight, retry int, opts ...MsgOption) (string, error) {
+	return EnQueueTypedContext(ctx, t.q, payload, weight, retry, t.name, opts...)
+}
+
+//消息出列，会堵塞
+func (t *TypedQueue[T]) DeQueue() (*TypedMsg[T], error) {
+	return t.DeQueueContext(context.Background())
+}
+
+//消息出列，会堵塞到有消息、队列退出或者ctx结束，队列退出后返回nil
+//无法解析的消息进入死信队列并返回错误
+func (t *TypedQueue[T]) DeQueueContext(ctx context.Context) (*TypedMsg[T], error) {
+	_, qm, err := t.q.DeQueueContext(ctx, t.name)
+	if err != nil || qm == nil {
+		return nil, err
+	}
+	if qm, _, err = checkQueueMsg(t.q, qm, t.name); err != nil || qm == nil {
+		return nil, err
+	}
+
+	payload, err := decodePayload[T](qm, t.strict)
+	if err != nil {
+		logger.LogError(fmt.Sprintf("消息体解析失败！%v,guid:%s", err, qm.UUID))
+		if dlerr := t.q.DeadLetter(qm, t.name, DeadReasonDecodeFailed, err); dlerr != nil {
+			logger.LogError(fmt.Sprintf("进入死信队列失败！%v,guid:%s", dlerr.Error(), qm.UUID))
+		}
+		return nil, err
+	}
+
+	return &TypedMsg[T]{QueueMsg: qm, Payload: payload}, nil
+}
+
+//带类型消息体的处理函数，消息体解析失败时按处理失败处理
+func TypedHandler[T any](h func(ctx context.Context, qm *QueueMsg, payload T) error) HandlerFunc {
+	return func(ctx context.Context, qm *QueueMsg) error {
+		payload, err := DecodePayload[T](qm)
+		if err != nil {
+			return err
+		}
+		return h(ctx, qm, payload)
+	}
+}
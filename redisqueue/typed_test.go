@@ -0,0 +1,123 @@
+package redisqueue
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+type createTable struct {
+	Cmd     string `json:"cmd"`
+	TableID int64  `json:"table_id"`
+	Seats   []int  `json:"seats"`
+}
+
+func TestTypedPayloadRoundTrip(t *testing.T) {
+	want := createTable{Cmd: "create_table", TableID: 1<<53 + 1, Seats: []int{1, 2, 3}}
+
+	qm, err := NewTypedQueueMsg(want, 2, 1)
+	if err != nil {
+		t.Fatalf("NewTypedQueueMsg: %v", err)
+	}
+
+	bt, err := json.Marshal(qm)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	got := new(QueueMsg)
+	if err := json.Unmarshal(bt, got); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+
+	payload, err := DecodePayload[createTable](got)
+	if err != nil {
+		t.Fatalf("DecodePayload: %v", err)
+	}
+	if payload.Cmd != want.Cmd || payload.TableID != want.TableID || len(payload.Seats) != 3 {
+		t.Errorf("payload = %#v, want %#v", payload, want)
+	}
+}
+
+func TestDecodePayloadFromMsg(t *testing.T) {
+	qm, _ := NewQueueMsg(map[string]interface{}{"cmd": "create_table", "table_id": 12}, 2, 1)
+
+	payload, err := DecodePayload[createTable](qm)
+	if err != nil {
+		t.Fatalf("DecodePayload: %v", err)
+	}
+	if payload.Cmd != "create_table" || payload.TableID != 12 {
+		t.Errorf("payload = %#v", payload)
+	}
+}
+
+func TestDecodePayloadEmpty(t *testing.T) {
+	qm, _ := NewQueueMsg(nil, 2, 1)
+
+	if _, err := DecodePayload[createTable](qm); err != ErrEmptyPayload {
+		t.Errorf("err = %v, want ErrEmptyPayload", err)
+	}
+}
+
+func TestDecodePayloadUnknownField(t *testing.T) {
+	qm, _ := NewTypedQueueMsg(map[string]interface{}{"cmd": "create_table", "room": 3}, 2, 1)
+
+	//生产者新增字段不影响旧的消费者
+	payload, err := DecodePayload[createTable](qm)
+	if err != nil || payload.Cmd != "create_table" {
+		t.Errorf("payload = %#v, %v", payload, err)
+	}
+	if _, err := decodePayload[createTable](qm, true); err == nil {
+		t.Error("want error for unknown field in strict mode")
+	}
+}
+
+func TestTypedQueueStrictDecode(t *testing.T) {
+	_, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, "")
+	tq := NewTypedQueue[createTable](q, "tables", WithStrictDecode())
+
+	if _, err := EnQueueTyped(q, map[string]interface{}{"cmd": "create_table", "room": 3}, 2, 1, "tables"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if msg, err := tq.DeQueueContext(ctx); err == nil {
+		t.Fatalf("got %#v, want decode error", msg)
+	}
+	dms, _ := q.DeadMsgs("tables", 0, -1)
+	if len(dms) != 1 || dms[0].Reason != DeadReasonDecodeFailed {
+		t.Errorf("dead = %+v", dms)
+	}
+}
+
+func TestTypedQueueBound(t *testing.T) {
+	s, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, "other")
+	q.Start()
+	defer q.Quit()
+
+	tq := NewTypedQueue[createTable](q, "tables")
+	if _, err := EnQueueTask(q, map[string]interface{}{"k": "v"}, 2, 1, "other"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tq.EnQueue(createTable{Cmd: "create_table", TableID: 7}, 2, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	msg, err := tq.DeQueueContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Payload.TableID != 7 {
+		t.Errorf("payload = %#v", msg.Payload)
+	}
+	if err := q.Ack(msg.QueueMsg); err != nil {
+		t.Error(err)
+	}
+	if s.Exists(q.DeadQueueName("other")) || s.Exists(q.DeadQueueName("tables")) {
+		t.Error("unexpected dead letters")
+	}
+}
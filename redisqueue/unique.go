@@ -0,0 +1,96 @@
+package redisqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/weikaishio/go-logger/logger"
+	"hallversion/common/qqredis"
+)
+
+var ErrDuplicateMsg = errors.New("redisqueue: duplicate message")
+
+//加唯一锁并入列，锁已经存在时返回持有锁的消息uuid，有效期为0时锁不过期
+var uniqueEnqueueScript = redis.NewScript(2, luaXadd+`
+local locked
+if tonumber(ARGV[2]) > 0 then
+	locked = redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2])
+else
+	locked = redis.call('SET', KEYS[1], ARGV[1], 'NX')
+end
+if not locked then
+	return redis.call('GET', KEYS[1])
+end
+if ARGV[4] == 'ZADD' then
+	redis.call('ZADD', KEYS[2], ARGV[5], ARGV[3])
+elseif ARGV[4] == 'XADD' then
+	xadd(KEYS[2], ARGV[5], ARGV[6], ARGV[3])
+else
+	redis.call('LPUSH', KEYS[2], ARGV[3])
+end
+return false
+`)
+
+//释放唯一锁，只释放自己持有的
+var uniqueReleaseScript = redis.NewScript(1, `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+//唯一键，window内相同唯一键的消息只会入列一次，重复入列返回ErrDuplicateMsg
+//消息Ack或者进入死信队列后释放，window小于1毫秒时一直持有到Ack或者进入死信队列
+func WithUniqueKey(key string, window time.Duration) MsgOption {
+	return func(qm *QueueMsg) {
+		qm.UniqueKey = key
+		qm.UniqueTTL = 0
+		if window >= time.Millisecond {
+			qm.UniqueTTL = int64(window / time.Millisecond)
+		}
+	}
+}
+
+//重复入列时不返回错误，消息的UUID改为已经在队列中的消息的UUID，需要和WithUniqueKey一起使用
+func WithUniqueCoalesce() MsgOption {
+	return func(qm *QueueMsg) {
+		qm.coalesce = true
+	}
+}
+
+//唯一锁
+func uniqueKey(queuename, key string) string {
+	return queuename + ":unique:" + key
+}
+
+//带唯一锁入列，cmd为LPUSH、ZADD（args为分数）或者XADD（args为maxlen和裁剪方式）
+func pushUnique(ctx context.Context, rc qqredis.RedisCache, model *QueueMsg, queuename, target string, bt []byte, cmd string, args ...interface{}) error {
+	keysAndArgs := []interface{}{uniqueKey(queuename, model.UniqueKey), target, model.UUID, model.UniqueTTL, bt, cmd}
+	reply, err := rc.EvalContext(ctx, uniqueEnqueueScript, append(keysAndArgs, args...)...)
+	if err != nil || reply == nil {
+		return err
+	}
+
+	existing, err := redis.String(reply, nil)
+	if err != nil {
+		return err
+	}
+	if model.coalesce {
+		model.UUID = existing
+		return nil
+	}
+	return ErrDuplicateMsg
+}
+
+//释放消息的唯一锁
+func releaseUnique(rc qqredis.RedisCache, qm *QueueMsg, queuename string) {
+	if qm.UniqueKey == "" {
+		return
+	}
+	if _, err := rc.EvalContext(msgContext(qm), uniqueReleaseScript, uniqueKey(queuename, qm.UniqueKey), qm.UUID); err != nil {
+		logger.LogWarn(fmt.Sprintf("RedisQueue release unique key error: %v, guid:%s", err, qm.UUID))
+	}
+}
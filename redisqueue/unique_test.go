@@ -0,0 +1,74 @@
+package redisqueue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUniqueKeyDedup(t *testing.T) {
+	s, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, "uq")
+
+	first, _ := NewQueueMsg(map[string]interface{}{"n": 1}, 2, 1, WithUniqueKey("order-1", time.Minute))
+	if err := q.EnQueue(first, "uq"); err != nil {
+		t.Fatal(err)
+	}
+	dup, _ := NewQueueMsg(map[string]interface{}{"n": 2}, 2, 1, WithUniqueKey("order-1", time.Minute))
+	if err := q.EnQueue(dup, "uq"); err != ErrDuplicateMsg {
+		t.Errorf("err = %v, want ErrDuplicateMsg", err)
+	}
+	if n, _ := s.List("uq"); len(n) != 1 {
+		t.Errorf("queue length = %d, want 1", len(n))
+	}
+	if ttl := s.TTL(uniqueKey("uq", "order-1")); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("lock ttl = %v", ttl)
+	}
+}
+
+func TestUniqueKeyCoalesce(t *testing.T) {
+	_, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, "uq")
+
+	first, _ := NewQueueMsg(map[string]interface{}{"n": 1}, 2, 1, WithUniqueKey("order-1", time.Minute))
+	if err := q.EnQueue(first, "uq"); err != nil {
+		t.Fatal(err)
+	}
+	dup, _ := NewQueueMsg(map[string]interface{}{"n": 2}, 2, 1, WithUniqueKey("order-1", time.Minute), WithUniqueCoalesce())
+	if err := q.EnQueue(dup, "uq"); err != nil {
+		t.Fatal(err)
+	}
+	if dup.UUID != first.UUID {
+		t.Errorf("coalesced uuid = %s, want %s", dup.UUID, first.UUID)
+	}
+}
+
+func TestUniqueKeyRelease(t *testing.T) {
+	s, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, "uq")
+
+	//window为0时一直持有到Ack
+	qm, _ := NewQueueMsg(map[string]interface{}{"n": 1}, 2, 1, WithUniqueKey("order-1", 0))
+	if err := q.EnQueue(qm, "uq"); err != nil {
+		t.Fatal(err)
+	}
+	lock := uniqueKey("uq", "order-1")
+	if !s.Exists(lock) || s.TTL(lock) != 0 {
+		t.Fatalf("lock exists = %v, ttl = %v", s.Exists(lock), s.TTL(lock))
+	}
+
+	_, got, err := q.DeQueue("uq")
+	if err != nil || got == nil {
+		t.Fatalf("DeQueue: %v", err)
+	}
+	if err := q.Ack(got); err != nil {
+		t.Fatal(err)
+	}
+	if s.Exists(lock) {
+		t.Error("lock not released after Ack")
+	}
+
+	again, _ := NewQueueMsg(map[string]interface{}{"n": 2}, 2, 1, WithUniqueKey("order-1", 0))
+	if err := q.EnQueue(again, "uq"); err != nil {
+		t.Errorf("enqueue after release: %v", err)
+	}
+}
@@ -0,0 +1,301 @@
+package redisqueue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/weikaishio/go-logger/logger"
+	"hallversion/common/qqredis"
+)
+
+var (
+	ErrNoHandler   = errors.New("redisqueue: no handler for queue")
+	ErrExecTimeout = errors.New("redisqueue: handler execution timeout")
+)
+
+// 消息处理函数，返回nil时消息会被Ack，返回错误或者panic时消息重试或者进入死信队列
+// qm是出列消息的副本，处理函数对qm的修改（Msg、Headers、Retry等）不会影响Ack、重试和死信
+type HandlerFunc func(ctx context.Context, qm *QueueMsg) error
+
+// 按队列名称分发消息的worker池
+type Worker struct {
+	q           Queue
+	concurrency int
+	ledger      *Ledger
+
+	mu          sync.RWMutex
+	handlers    map[string]HandlerFunc
+	timeouts    map[string]time.Duration
+	middlewares []Middleware
+
+	running   int32
+	busy      int32
+	processed uint64
+	failed    uint64
+}
+
+// worker的运行状态
+type WorkerStats struct {
+	Running     bool     `json:"running"`     //是否在运行
+	Concurrency int      `json:"concurrency"` //协程数
+	Busy        int      `json:"busy"`        //正在处理消息的协程数
+	Processed   uint64   `json:"processed"`   //处理成功的消息数
+	Failed      uint64   `json:"failed"`      //处理失败的消息数
+	Queues      []string `json:"queues"`      //注册了处理函数的队列
+}
+
+// worker的配置项
+type WorkerOption func(*Worker)
+
+//处理前查询台账，已经处理过的消息直接Ack，不再调用处理函数；处理成功后记录到台账
+func WithLedger(l *Ledger) WorkerOption {
+	return func(w *Worker) {
+		w.ledger = l
+	}
+}
+
+//新建worker，concurrency为同时处理消息的协程数
+func NewWorker(q Queue, concurrency int, opts ...WorkerOption) *Worker {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	w := &Worker{
+		q:           q,
+		concurrency: concurrency,
+		handlers:    make(map[string]HandlerFunc),
+		timeouts:    make(map[string]time.Duration),
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	return w
+}
+
+//注册队列的处理函数
+func (w *Worker) Handle(queuename string, h HandlerFunc) {
+	w.mu.Lock()
+	w.handlers[queuename] = h
+	w.mu.Unlock()
+}
+
+//设置队列的处理超时时间，超时后处理函数的ctx会被取消，消息按处理失败重试或者进入死信队列
+//消息自身的ExecTimeout优先，见WithExecTimeout
+func (w *Worker) Timeout(queuename string, timeout time.Duration) {
+	w.mu.Lock()
+	w.timeouts[queuename] = timeout
+	w.mu.Unlock()
+}
+
+//添加中间件，作用于所有队列的处理函数，先添加的在外层
+func (w *Worker) Use(mws ...Middleware) {
+	w.mu.Lock()
+	w.middlewares = append(w.middlewares, mws...)
+	w.mu.Unlock()
+}
+
+func (w *Worker) handler(queuename string) (HandlerFunc, time.Duration) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	h := w.handlers[queuename]
+	if h != nil && len(w.middlewares) > 0 {
+		h = Chain(h, w.middlewares...)
+	}
+	return h, w.timeouts[queuename]
+}
+
+//启动worker，会阻塞到队列退出（Quit/Shutdown）或者ctx结束，并且正在执行的处理函数全部结束
+//ctx会传给处理函数
+func (w *Worker) Run(ctx context.Context) {
+	atomic.StoreInt32(&w.running, 1)
+	defer atomic.StoreInt32(&w.running, 0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < w.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.loop(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (w *Worker) loop(ctx context.Context) {
+	for ctx.Err() == nil {
+		qm, qname, err := DeQueueTaskContext(ctx, w.q)
+		if qm != nil {
+			w.process(ctx, qm, qname)
+			continue
+		}
+		if ctx.Err() != nil || !w.q.IsRunning() {
+			return
+		}
+		if err != nil {
+			//过期的和没有消息体的消息已经进入死信队列
+			logger.LogWarn(err.Error())
+		}
+	}
+}
+
+//处理一条消息：成功Ack，失败重试或者进入死信队列
+func (w *Worker) process(ctx context.Context, qm *QueueMsg, qname string) {
+	atomic.AddInt32(&w.busy, 1)
+	defer atomic.AddInt32(&w.busy, -1)
+
+	h, timeout := w.handler(qname)
+	if h == nil {
+		atomic.AddUint64(&w.failed, 1)
+		FailQueueTask(w.q, qm, qname, ErrNoHandler)
+		return
+	}
+
+	if w.ledger != nil {
+		//台账不可用时照常处理
+		seen, err := w.ledger.Seen(ctx, qname, qm.UUID)
+		if err != nil {
+			logger.LogWarn(fmt.Sprintf("读取消息台账失败！%v,guid:%s,queue:%s", err, qm.UUID, qname))
+		}
+		if seen {
+			logger.LogInfo(fmt.Sprintf("消息已经处理过，跳过,guid:%s,queue:%s", qm.UUID, qname))
+			w.ledger.skip()
+			w.ack(qm, qname)
+			return
+		}
+	}
+
+	if qm.ExecTimeout > 0 {
+		timeout = time.Duration(qm.ExecTimeout) * time.Millisecond
+	}
+
+	hctx, span := StartConsumerSpan(ctx, w.q, qm, qname)
+	start := time.Now()
+	err := callTimeout(hctx, h, qm, timeout)
+	metricsOf(w.q).ObserveHandlerLatency(qname, time.Since(start))
+	qqredis.EndSpan(span, err)
+	if err != nil && ctx.Err() != nil {
+		//worker退出导致的失败不计入重试次数
+		w.release(qm, qname, err)
+		return
+	}
+	if err != nil {
+		logger.LogError(fmt.Sprintf("消息处理失败！%v,guid:%s,queue:%s", err, qm.UUID, qname))
+		atomic.AddUint64(&w.failed, 1)
+		FailQueueTask(w.q, qm, qname, err)
+		return
+	}
+	atomic.AddUint64(&w.processed, 1)
+
+	if w.ledger != nil {
+		if err := w.ledger.Mark(context.Background(), qname, qm.UUID); err != nil {
+			logger.LogWarn(fmt.Sprintf("写入消息台账失败！%v,guid:%s,queue:%s", err, qm.UUID, qname))
+		}
+	}
+	w.ack(qm, qname)
+}
+
+func (w *Worker) ack(qm *QueueMsg, qname string) {
+	if err := w.q.Ack(qm); err != nil {
+		logger.LogError(fmt.Sprintf("消息确认失败！%v,guid:%s,queue:%s", err, qm.UUID, qname))
+	}
+}
+
+//把消息原样放回队列，队列不支持时按处理失败处理
+func (w *Worker) release(qm *QueueMsg, qname string, cause error) {
+	r, ok := w.q.(interface{ release(qm *QueueMsg) error })
+	if !ok {
+		FailQueueTask(w.q, qm, qname, cause)
+		return
+	}
+	if err := r.release(qm); err != nil {
+		logger.LogError(fmt.Sprintf("消息放回队列失败！%v,guid:%s,queue:%s", err, qm.UUID, qname))
+		return
+	}
+	logger.LogInfo(fmt.Sprintf("worker退出，消息放回队列,guid:%s,queue:%s", qm.UUID, qname))
+}
+
+//运行状态
+func (w *Worker) Stats() WorkerStats {
+	w.mu.RLock()
+	queues := make([]string, 0, len(w.handlers))
+	for name := range w.handlers {
+		queues = append(queues, name)
+	}
+	w.mu.RUnlock()
+	sort.Strings(queues)
+
+	return WorkerStats{
+		Running:     atomic.LoadInt32(&w.running) != 0,
+		Concurrency: w.concurrency,
+		Busy:        int(atomic.LoadInt32(&w.busy)),
+		Processed:   atomic.LoadUint64(&w.processed),
+		Failed:      atomic.LoadUint64(&w.failed),
+		Queues:      queues,
+	}
+}
+
+//调用处理函数，timeout大于0时超时返回ErrExecTimeout
+//处理函数拿到的始终是qm的副本，不管有没有超时时间，行为都一样
+//不响应ctx的处理函数超时后仍然会继续执行，但是结果会被忽略
+//ctx本身结束（worker退出）时等待处理函数返回
+func callTimeout(ctx context.Context, h HandlerFunc, qm *QueueMsg, timeout time.Duration) error {
+	hqm := qm.clone()
+	if timeout <= 0 {
+		return safeCall(ctx, h, hqm)
+	}
+
+	tctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- safeCall(tctx, h, hqm)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil && ctx.Err() == nil && tctx.Err() == context.DeadlineExceeded {
+			return ErrExecTimeout
+		}
+		return err
+	case <-tctx.Done():
+		if ctx.Err() != nil {
+			return <-done
+		}
+		return ErrExecTimeout
+	}
+}
+
+//消息的副本，Msg和Headers复制一层
+func (qm *QueueMsg) clone() *QueueMsg {
+	c := *qm
+	if qm.Msg != nil {
+		c.Msg = make(map[string]interface{}, len(qm.Msg))
+		for k, v := range qm.Msg {
+			c.Msg[k] = v
+		}
+	}
+	if qm.Body != nil {
+		c.Body = append(json.RawMessage(nil), qm.Body...)
+	}
+	c.Headers = qm.CopyHeaders()
+	return &c
+}
+
+//调用处理函数，panic转成错误
+func safeCall(ctx context.Context, h HandlerFunc, qm *QueueMsg) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.LogError(fmt.Sprintf("HandlerFunc panic, err:%v", r))
+			logger.LogError(string(debug.Stack()))
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return h(ctx, qm)
+}
@@ -0,0 +1,123 @@
+package redisqueue
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCallTimeoutCopiesMsg(t *testing.T) {
+	s, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, "wt", WithRetryPolicy(RetryPolicy{}))
+
+	if _, err := EnQueueTask(q, map[string]interface{}{"n": 1}, 2, 1, "wt"); err != nil {
+		t.Fatal(err)
+	}
+	_, qm, err := q.DeQueue("wt")
+	if err != nil || qm == nil {
+		t.Fatalf("DeQueue: %v", err)
+	}
+
+	release := make(chan struct{})
+	done := make(chan struct{})
+	h := func(ctx context.Context, qm *QueueMsg) error {
+		defer close(done)
+		<-release
+		//超时后还在修改消息，不能影响重新入列的消息
+		qm.SetHeader("late", "1")
+		qm.Msg["late"] = true
+		qm.Retry = 100
+		return nil
+	}
+	if err := callTimeout(context.Background(), h, qm, 20*time.Millisecond); err != ErrExecTimeout {
+		t.Fatalf("err = %v, want ErrExecTimeout", err)
+	}
+	close(release)
+	FailQueueTask(q, qm, "wt", ErrExecTimeout)
+	<-done
+
+	items, _ := s.List("wt")
+	if len(items) != 1 {
+		t.Fatalf("ready = %v, want the retried message", items)
+	}
+	got := new(QueueMsg)
+	if err := decodeMsg([]byte(items[0]), got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Retry != 0 || got.Attempt != 1 || got.Header("late") != "" || got.Msg["late"] != nil {
+		t.Errorf("requeued = %+v", got)
+	}
+}
+
+func TestCallNoTimeoutCopiesMsg(t *testing.T) {
+	qm, _ := NewQueueMsg(map[string]interface{}{"n": 1}, 2, 1, WithHeader("a", "1"))
+
+	//没有超时时间时同样拿到副本
+	h := func(ctx context.Context, hqm *QueueMsg) error {
+		if hqm == qm {
+			t.Error("handler got the dequeued message")
+		}
+		hqm.SetHeader("a", "changed")
+		hqm.Msg["n"] = 2
+		hqm.Retry = 100
+		return nil
+	}
+	if err := callTimeout(context.Background(), h, qm, 0); err != nil {
+		t.Fatal(err)
+	}
+	if qm.Header("a") != "1" || qm.Msg["n"] != 1 || qm.Retry != 1 {
+		t.Errorf("message changed by handler: %+v", qm)
+	}
+}
+
+func TestWorkerCancelReleases(t *testing.T) {
+	s, rc := newTestRedis(t)
+	q := NewRedisQueue(rc, "wc")
+	q.Start()
+
+	w := NewWorker(q, 1)
+	w.Timeout("wc", time.Minute)
+	started := make(chan struct{})
+	finished := make(chan struct{})
+	w.Handle("wc", func(ctx context.Context, qm *QueueMsg) error {
+		close(started)
+		<-ctx.Done()
+		time.Sleep(50 * time.Millisecond)
+		close(finished)
+		return ctx.Err()
+	})
+
+	if _, err := EnQueueTask(q, map[string]interface{}{"n": 1}, 2, 1, "wc"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		w.Run(ctx)
+		close(stopped)
+	}()
+
+	<-started
+	cancel()
+	<-stopped
+	select {
+	case <-finished:
+	default:
+		t.Fatal("Run returned before the handler")
+	}
+	if err := q.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	items, _ := s.List("wc")
+	if len(items) != 1 {
+		t.Fatalf("ready = %v, want the released message", items)
+	}
+	qm := new(QueueMsg)
+	if err := decodeMsg([]byte(items[0]), qm); err != nil {
+		t.Fatal(err)
+	}
+	if qm.Retry != 1 || qm.Attempt != 0 {
+		t.Errorf("released retry = %d, attempt = %d, want unchanged", qm.Retry, qm.Attempt)
+	}
+}